@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -28,17 +30,34 @@ func NewAPIServer(port int, db *DBEngine, raftNode *RaftNode, crdtStore *CRDTSto
 
 // Start starts the API server
 func (s *APIServer) Start() error {
-	http.HandleFunc("/", s.handleRoot)
-	http.HandleFunc("/api/v1/insert", s.handleInsert)
-	http.HandleFunc("/api/v1/query", s.handleQuery)
-	http.HandleFunc("/api/v1/history", s.handleHistory)
-	http.HandleFunc("/api/v1/temporal", s.handleTemporal)
-	http.HandleFunc("/api/v1/status", s.handleStatus)
-	http.HandleFunc("/api/v1/crdt/counter", s.handleCounter)
-
 	addr := fmt.Sprintf(":" + "%d", s.port)
 	log.Printf("API server listening on %s\n", addr)
-	return http.ListenAndServe(addr, nil)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// Handler returns the API routes, so several nodes can serve from one
+// process in tests
+func (s *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleRoot)
+	mux.HandleFunc("/api/v1/insert", s.handleInsert)
+	mux.HandleFunc("/api/v1/correct", s.handleCorrect)
+	mux.HandleFunc("/api/v1/delete", s.handleDelete)
+	mux.HandleFunc("/api/v1/query", s.handleQuery)
+	mux.HandleFunc("/api/v1/history", s.handleHistory)
+	mux.HandleFunc("/api/v1/temporal", s.handleTemporal)
+	mux.HandleFunc("/api/v1/temporal/range", s.handleTemporalRange)
+	mux.HandleFunc("/api/v1/timeline", s.handleTimeline)
+	mux.HandleFunc("/api/v1/diff", s.handleDiff)
+	mux.HandleFunc("/api/v1/status", s.handleStatus)
+	mux.HandleFunc("/api/v1/crdt/counter", s.handleCounter)
+	mux.HandleFunc("/api/v1/admin/members", s.handleMembers)
+	mux.HandleFunc("/api/v1/admin/add-voter", s.handleAddVoter)
+	mux.HandleFunc("/api/v1/admin/add-learner", s.handleAddLearner)
+	mux.HandleFunc("/api/v1/admin/promote", s.handlePromote)
+	mux.HandleFunc("/api/v1/admin/remove", s.handleRemove)
+	mux.HandleFunc("/api/v1/admin/transfer-leader", s.handleTransferLeader)
+	return mux
 }
 
 // handleRoot handles root endpoint
@@ -72,7 +91,7 @@ func (s *APIServer) handleInsert(w http.ResponseWriter, r *http.Request) {
 
 	// Parse time or use defaults
 	validStart := time.Now()
-	validEnd := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	validEnd := endOfTime
 
 	if req.ValidStart != "" {
 		if t, err := time.Parse(time.RFC3339, req.ValidStart); err == nil {
@@ -85,8 +104,20 @@ func (s *APIServer) handleInsert(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := s.db.Insert(req.Key, req.Value, validStart, validEnd); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !validEnd.After(validStart) {
+		http.Error(w, ErrEmptyPeriod.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cmd := Command{
+		Type:       CmdInsert,
+		Key:        req.Key,
+		Value:      req.Value,
+		ValidStart: validStart,
+		ValidEnd:   validEnd,
+	}
+	if err := s.raftNode.Apply(cmd); err != nil {
+		s.writeApplyError(w, r, err)
 		return
 	}
 
@@ -97,6 +128,130 @@ func (s *APIServer) handleInsert(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleCorrect records a retroactive correction: value replaces whatever
+// was recorded for the key during [valid_start, valid_end), and the parts of
+// overlapping records outside that period are kept
+func (s *APIServer) handleCorrect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key        string      `json:"key"`
+		Value      interface{} `json:"value"`
+		ValidStart string      `json:"valid_start"`
+		ValidEnd   string      `json:"valid_end"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	validStart, err := time.Parse(time.RFC3339, req.ValidStart)
+	if err != nil {
+		http.Error(w, "valid_start must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	validEnd, err := time.Parse(time.RFC3339, req.ValidEnd)
+	if err != nil {
+		http.Error(w, "valid_end must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if !validEnd.After(validStart) {
+		http.Error(w, ErrEmptyPeriod.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cmd := Command{
+		Type:       CmdCorrect,
+		Key:        req.Key,
+		Value:      req.Value,
+		ValidStart: validStart,
+		ValidEnd:   validEnd,
+	}
+	if err := s.raftNode.Apply(cmd); err != nil {
+		s.writeApplyError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":      "corrected",
+		"key":         req.Key,
+		"valid_start": validStart.Format(time.RFC3339),
+		"valid_end":   validEnd.Format(time.RFC3339),
+	})
+}
+
+// handleDelete retracts a key's value for [valid_start, valid_end), by
+// default from now on. Earlier as_of queries still see the value.
+func (s *APIServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key        string `json:"key"`
+		ValidStart string `json:"valid_start,omitempty"`
+		ValidEnd   string `json:"valid_end,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	validStart := time.Now()
+	validEnd := endOfTime
+	if req.ValidStart != "" {
+		t, err := time.Parse(time.RFC3339, req.ValidStart)
+		if err != nil {
+			http.Error(w, "valid_start must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		validStart = t
+	}
+	if req.ValidEnd != "" {
+		t, err := time.Parse(time.RFC3339, req.ValidEnd)
+		if err != nil {
+			http.Error(w, "valid_end must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		validEnd = t
+	}
+	if !validEnd.After(validStart) {
+		http.Error(w, ErrEmptyPeriod.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cmd := Command{
+		Type:       CmdDelete,
+		Key:        req.Key,
+		ValidStart: validStart,
+		ValidEnd:   validEnd,
+	}
+	if err := s.raftNode.Apply(cmd); err != nil {
+		s.writeApplyError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":      "deleted",
+		"key":         req.Key,
+		"valid_start": validStart.Format(time.RFC3339),
+		"valid_end":   validEnd.Format(time.RFC3339),
+	})
+}
+
 // handleQuery handles current value queries
 func (s *APIServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
@@ -105,6 +260,10 @@ func (s *APIServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.readBarrier(w, r) {
+		return
+	}
+
 	value, found := s.db.QueryCurrent(key)
 	w.Header().Set("Content-Type", "application/json")
 
@@ -131,6 +290,10 @@ func (s *APIServer) handleHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.readBarrier(w, r) {
+		return
+	}
+
 	history := s.db.GetHistory(key)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -150,7 +313,11 @@ func (s *APIServer) handleTemporal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	asOf := time.Now()
+	if !s.readBarrier(w, r) {
+		return
+	}
+
+	asOf := s.db.ReadTime()
 	validTime := time.Now()
 
 	if asOfStr != "" {
@@ -176,16 +343,218 @@ func (s *APIServer) handleTemporal(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleTemporalRange returns the records of a key, as known at as_of, whose
+// valid-time period stands in an Allen relation to the period [start, end)
+func (s *APIServer) handleTemporalRange(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		http.Error(w, "key parameter required", http.StatusBadRequest)
+		return
+	}
+
+	start, err := time.Parse(time.RFC3339, query.Get("start"))
+	if err != nil {
+		http.Error(w, "start must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	end, err := time.Parse(time.RFC3339, query.Get("end"))
+	if err != nil {
+		http.Error(w, "end must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if !end.After(start) {
+		http.Error(w, "end must be after start", http.StatusBadRequest)
+		return
+	}
+	relation, err := ParseAllenRelation(query.Get("relation"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	asOf, err := timeParam(query, "as_of", time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.readBarrier(w, r) {
+		return
+	}
+	if asOf.IsZero() {
+		asOf = s.db.ReadTime()
+	}
+
+	records := s.db.QueryRange(key, asOf, Period{Start: start, End: end}, relation)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":      key,
+		"as_of":    asOf.Format(time.RFC3339),
+		"start":    start.Format(time.RFC3339),
+		"end":      end.Format(time.RFC3339),
+		"relation": relation,
+		"records":  records,
+	})
+}
+
+// handleTimeline returns the values a key had across the valid-time range
+// [from, to), as known at as_of, with adjacent equal values merged. The range
+// defaults to all of valid time.
+func (s *APIServer) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		http.Error(w, "key parameter required", http.StatusBadRequest)
+		return
+	}
+
+	from, err := timeParam(query, "from", time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := timeParam(query, "to", endOfTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	asOf, err := timeParam(query, "as_of", time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !to.After(from) {
+		http.Error(w, "to must be after from", http.StatusBadRequest)
+		return
+	}
+
+	if !s.readBarrier(w, r) {
+		return
+	}
+	if asOf.IsZero() {
+		asOf = s.db.ReadTime()
+	}
+
+	timeline := s.db.QueryTimeline(key, asOf, from, to)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":      key,
+		"as_of":    asOf.Format(time.RFC3339),
+		"from":     from.Format(time.RFC3339),
+		"to":       to.Format(time.RFC3339),
+		"timeline": timeline,
+	})
+}
+
+// handleDiff returns how what was recorded for a key changed between
+// transaction times t1 and t2: the facts added, superseded and retracted
+func (s *APIServer) handleDiff(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		http.Error(w, "key parameter required", http.StatusBadRequest)
+		return
+	}
+	if query.Get("t1") == "" {
+		http.Error(w, "t1 parameter required", http.StatusBadRequest)
+		return
+	}
+
+	t1, err := timeParam(query, "t1", time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t2, err := timeParam(query, "t2", time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.readBarrier(w, r) {
+		return
+	}
+	if t2.IsZero() {
+		t2 = s.db.ReadTime()
+	}
+	if !t2.After(t1) {
+		http.Error(w, "t2 must be after t1", http.StatusBadRequest)
+		return
+	}
+
+	changes := s.db.Diff(key, t1, t2)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     key,
+		"t1":      t1.Format(time.RFC3339),
+		"t2":      t2.Format(time.RFC3339),
+		"changes": changes,
+	})
+}
+
+// timeParam parses the RFC 3339 query parameter name, or returns def when
+// it is absent
+func timeParam(query url.Values, name string, def time.Time) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return t, nil
+}
+
+// readBarrier applies the consistency or max_staleness query parameter of a
+// read request, redirecting reads a follower cannot serve to the leader. It
+// reports whether the read may go ahead.
+func (s *APIServer) readBarrier(w http.ResponseWriter, r *http.Request) bool {
+	if maxStaleness := r.URL.Query().Get("max_staleness"); maxStaleness != "" {
+		bound, err := ParseStaleness(maxStaleness)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		if err := s.raftNode.BoundedStaleRead(bound); err != nil {
+			s.writeApplyError(w, r, err)
+			return false
+		}
+		return true
+	}
+
+	level, err := ParseReadConsistency(r.URL.Query().Get("consistency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if err := s.raftNode.ReadBarrier(level); err != nil {
+		s.writeApplyError(w, r, err)
+		return false
+	}
+	return true
+}
+
 // handleStatus returns cluster status
 func (s *APIServer) handleStatus(w http.ResponseWriter, r *http.Request) {
-	state, term := s.raftNode.GetState()
+	status := s.raftNode.Status()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"node_id":     s.raftNode.nodeID,
-		"raft_state":  state,
-		"raft_term":   term,
-		"timestamp":   time.Now().Format(time.RFC3339),
+		"node_id":        s.raftNode.nodeID,
+		"raft_state":     status.State,
+		"raft_term":      status.Term,
+		"raft_role":      status.Role,
+		"leader_id":      status.LeaderID,
+		"leader_addr":    status.LeaderAddr,
+		"commit_index":   status.CommitIndex,
+		"last_applied":   status.LastApplied,
+		"last_log_index": status.LastLogIndex,
+		"log_size":       status.LogSize,
+		"snapshot_index": status.SnapshotIndex,
+		"raft_stats":     s.raftNode.Stats(),
+		"peers":          status.Peers,
+		"timestamp":      time.Now().Format(time.RFC3339),
 	})
 }
 
@@ -199,7 +568,16 @@ func (s *APIServer) handleCounter(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodPost {
 		// Increment counter
-		s.crdtStore.IncrementCounter(key, s.raftNode.nodeID, 1)
+		cmd := Command{
+			Type:   CmdCounterIncrement,
+			Key:    key,
+			NodeID: s.raftNode.nodeID,
+			Delta:  1,
+		}
+		if err := s.raftNode.Apply(cmd); err != nil {
+			s.writeApplyError(w, r, err)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "incremented",
@@ -209,6 +587,9 @@ func (s *APIServer) handleCounter(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// GET - return counter value
+	if !s.readBarrier(w, r) {
+		return
+	}
 	count := s.crdtStore.GetCounter(key)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -216,3 +597,126 @@ func (s *APIServer) handleCounter(w http.ResponseWriter, r *http.Request) {
 		"value": count,
 	})
 }
+
+// handleMembers returns the cluster configuration as seen by this node
+func (s *APIServer) handleMembers(w http.ResponseWriter, r *http.Request) {
+	members, configIndex := s.raftNode.Membership()
+	state, term := s.raftNode.GetState()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_id":      s.raftNode.nodeID,
+		"raft_state":   state,
+		"raft_term":    term,
+		"config_index": configIndex,
+		"voters":       members.Voters,
+		"learners":     members.Learners,
+	})
+}
+
+// handleAddVoter adds a voting member: POST /api/v1/admin/add-voter?id=&addr=
+func (s *APIServer) handleAddVoter(w http.ResponseWriter, r *http.Request) {
+	s.changeMembership(w, r, func(id, addr string) error {
+		return s.raftNode.AddVoter(id, addr)
+	})
+}
+
+// handleAddLearner adds a non-voting member: POST /api/v1/admin/add-learner?id=&addr=
+func (s *APIServer) handleAddLearner(w http.ResponseWriter, r *http.Request) {
+	s.changeMembership(w, r, func(id, addr string) error {
+		return s.raftNode.AddLearner(id, addr)
+	})
+}
+
+// handlePromote turns a learner into a voter: POST /api/v1/admin/promote?id=
+func (s *APIServer) handlePromote(w http.ResponseWriter, r *http.Request) {
+	s.changeMembership(w, r, func(id, addr string) error {
+		return s.raftNode.PromoteLearner(id)
+	})
+}
+
+// handleRemove removes a voter or learner: POST /api/v1/admin/remove?id=
+func (s *APIServer) handleRemove(w http.ResponseWriter, r *http.Request) {
+	s.changeMembership(w, r, func(id, addr string) error {
+		return s.raftNode.RemoveNode(id)
+	})
+}
+
+// handleTransferLeader hands leadership to another voter:
+// POST /api/v1/admin/transfer-leader?to= (the most up to date voter if empty)
+func (s *APIServer) handleTransferLeader(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.raftNode.TransferLeadership(r.URL.Query().Get("to")); err != nil {
+		s.writeApplyError(w, r, err)
+		return
+	}
+	leaderID, leaderAddr := s.raftNode.Leader()
+	state, term := s.raftNode.GetState()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "success",
+		"node_id":     s.raftNode.nodeID,
+		"raft_state":  state,
+		"raft_term":   term,
+		"leader_id":   leaderID,
+		"leader_addr": leaderAddr,
+	})
+}
+
+// changeMembership runs a membership change taken from the id and addr
+// query parameters and reports the resulting configuration
+func (s *APIServer) changeMembership(w http.ResponseWriter, r *http.Request, change func(id, addr string) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id parameter required", http.StatusBadRequest)
+		return
+	}
+
+	if err := change(id, r.URL.Query().Get("addr")); err != nil {
+		s.writeApplyError(w, r, err)
+		return
+	}
+	s.handleMembers(w, r)
+}
+
+// writeApplyError maps a failed Raft write or read barrier to an HTTP error.
+// Requests sent to a follower are redirected to the leader with 307
+// Temporary Redirect, which keeps the method and body; the JSON body names
+// the leader for clients that do not follow redirects.
+func (s *APIServer) writeApplyError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNotLeader), errors.Is(err, ErrTooStale):
+		leaderID, leaderAddr := s.raftNode.Leader()
+		status := http.StatusServiceUnavailable
+		if leaderAddr != "" {
+			w.Header().Set("Location", "http://"+leaderAddr+r.URL.RequestURI())
+			status = http.StatusTemporaryRedirect
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":       err.Error(),
+			"leader_id":   leaderID,
+			"leader_addr": leaderAddr,
+		})
+	case errors.Is(err, ErrInvalidConfigChange), errors.Is(err, ErrInvalidTransfer), errors.Is(err, ErrEmptyPeriod):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrConfigChangePending), errors.Is(err, ErrTransferInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrLeadershipLost), errors.Is(err, ErrLeadershipUnconfirmed), errors.Is(err, ErrShutdown):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrApplyTimeout), errors.Is(err, ErrTransferTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve sends a request to node id's API handlers and returns the response
+func (c *testCluster) serve(id, method, target, body string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	server := NewAPIServer(0, c.dbs[id], c.nodes[id], NewCRDTStore())
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// follower returns a node other than leader
+func (c *testCluster) follower(leader *RaftNode) *RaftNode {
+	for id, node := range c.nodes {
+		if id != leader.nodeID {
+			return node
+		}
+	}
+	c.t.Fatal("cluster has no follower")
+	return nil
+}
+
+// notLeaderBody decodes the structured response to a request a node could
+// not serve
+func notLeaderBody(t *testing.T, w *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("decode %s response: %v", w.Result().Status, err)
+	}
+	return body
+}
+
+func TestFollowerRedirectsWritesToLeader(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.write("warmup", "done")
+	follower := c.follower(leader)
+	waitFor(t, 5*time.Second, "the follower to learn the leader", func() bool {
+		id, _ := follower.Leader()
+		return id == leader.nodeID
+	})
+
+	w := c.serve(follower.nodeID, http.MethodPost, "/api/v1/insert?source=test", `{"key":"k","value":"v"}`)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("follower answered a write with %d, want 307", w.Code)
+	}
+	if location, want := w.Header().Get("Location"), "http://"+apiAddr(leader.nodeID)+"/api/v1/insert?source=test"; location != want {
+		t.Errorf("Location = %q, want %q", location, want)
+	}
+	body := notLeaderBody(t, w)
+	if body["leader_id"] != leader.nodeID || body["leader_addr"] != apiAddr(leader.nodeID) || body["error"] != ErrNotLeader.Error() {
+		t.Errorf("redirect body = %v, want the leader %s at %s", body, leader.nodeID, apiAddr(leader.nodeID))
+	}
+
+	// Following the redirect stores the write
+	w = c.serve(leader.nodeID, http.MethodPost, "/api/v1/insert", `{"key":"k","value":"v"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("leader answered the write with %d: %s", w.Code, w.Body)
+	}
+	c.converged("k", "v", "n1", "n2", "n3")
+}
+
+func TestFollowerRedirectsCounterReads(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.write("warmup", "done")
+	follower := c.follower(leader)
+	waitFor(t, 5*time.Second, "the follower to learn the leader", func() bool {
+		id, _ := follower.Leader()
+		return id == leader.nodeID
+	})
+
+	target := "/api/v1/crdt/counter?key=hits"
+	w := c.serve(follower.nodeID, http.MethodGet, target, "")
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("follower answered a linearizable counter read with %d, want 307", w.Code)
+	}
+	if location, want := w.Header().Get("Location"), "http://"+apiAddr(leader.nodeID)+target; location != want {
+		t.Errorf("Location = %q, want %q", location, want)
+	}
+	if w := c.serve(follower.nodeID, http.MethodGet, target+"&consistency=stale", ""); w.Code != http.StatusOK {
+		t.Errorf("follower answered a stale counter read with %d, want 200: %s", w.Code, w.Body)
+	}
+	if w := c.serve(leader.nodeID, http.MethodGet, target, ""); w.Code != http.StatusOK {
+		t.Errorf("leader answered a counter read with %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestWriteWithoutLeaderReturnsNotLeader(t *testing.T) {
+	c := newTestCluster(t, 1)
+	c.leader(0)
+	// A node waiting to join has never heard of a leader
+	c.start("lonely", nil)
+
+	w := c.serve("lonely", http.MethodPost, "/api/v1/insert", `{"key":"k","value":"v"}`)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("leaderless node answered a write with %d, want 503", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "" {
+		t.Errorf("leaderless node redirected to %q", location)
+	}
+	body := notLeaderBody(t, w)
+	if body["error"] != ErrNotLeader.Error() || body["leader_id"] != "" || body["leader_addr"] != "" {
+		t.Errorf("not-leader body = %v, want the error with an empty leader", body)
+	}
+}
+
+func TestBoundedStalenessReadsForwardLaggingFollower(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.write("k", "old")
+	c.converged("k", "old", "n1", "n2", "n3")
+
+	lagging := c.follower(leader)
+	var current *RaftNode
+	for id, node := range c.nodes {
+		if id != leader.nodeID && id != lagging.nodeID {
+			current = node
+		}
+	}
+	c.network.Partition([]string{lagging.nodeID})
+	c.write("k", "new")
+	c.converged("k", "new", current.nodeID)
+	// Long enough for the cut-off follower to stop counting on the leader
+	time.Sleep(300 * time.Millisecond)
+
+	for _, bound := range []string{"200ms", "5"} {
+		target := "/api/v1/query?key=k&max_staleness=" + bound
+		w := c.serve(lagging.nodeID, http.MethodGet, target, "")
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Errorf("lagging follower answered max_staleness=%s with %d: %s", bound, w.Code, w.Body)
+		} else if location, want := w.Header().Get("Location"), "http://"+apiAddr(leader.nodeID)+target; location != want {
+			t.Errorf("lagging follower redirected max_staleness=%s to %q, want %q", bound, location, want)
+		}
+
+		// The follower still hearing from the leader serves the read itself
+		waitFor(t, 5*time.Second, "a local read on "+current.nodeID, func() bool {
+			w := c.serve(current.nodeID, http.MethodGet, target, "")
+			var body map[string]interface{}
+			return w.Code == http.StatusOK && json.NewDecoder(w.Body).Decode(&body) == nil && body["value"] == "new"
+		})
+	}
+
+	// Without a bound the lagging follower would have served the old value
+	if err := lagging.BoundedStaleRead(Staleness{MaxAge: time.Hour}); err != nil {
+		t.Errorf("BoundedStaleRead with a loose bound: %v", err)
+	}
+	if got, _ := c.dbs[lagging.nodeID].QueryCurrent("k"); got != "old" {
+		t.Errorf("lagging follower holds %v, want old", got)
+	}
+}
+
+func TestPartitionedLeaderRefusesReads(t *testing.T) {
+	c := newTestClusterWithConfig(t, 3, RaftConfig{ElectionTimeoutMS: 1000, HeartbeatIntervalMS: 20})
+	old := c.leader(0)
+	c.write("k", "v")
+	_, term := old.GetState()
+	var rest []string
+	for id := range c.nodes {
+		if id != old.nodeID {
+			rest = append(rest, id)
+		}
+	}
+	c.network.Partition([]string{old.nodeID}, rest)
+
+	// ReadIndex needs a quorum even while the lease still holds
+	if w := c.serve(old.nodeID, http.MethodGet, "/api/v1/query?key=k", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("cut-off leader answered a linearizable read with %d, want 503: %s", w.Code, w.Body)
+	}
+	for _, query := range []string{"consistency=lease", "max_staleness=1s"} {
+		if w := c.serve(old.nodeID, http.MethodGet, "/api/v1/query?key=k&"+query, ""); w.Code != http.StatusOK {
+			t.Errorf("cut-off leader answered %s within its lease with %d, want 200: %s", query, w.Code, w.Body)
+		}
+	}
+
+	// The lease ends before checkQuorum steps the leader down
+	var stillLeader bool
+	waitFor(t, 5*time.Second, "the lease to run out", func() bool {
+		old.mu.RLock()
+		defer old.mu.RUnlock()
+		stillLeader = old.state == Leader
+		return !old.leaseValid()
+	})
+	if !stillLeader {
+		t.Fatalf("leader stepped down before its lease ran out")
+	}
+	for _, query := range []string{"consistency=lease", "max_staleness=1s"} {
+		if w := c.serve(old.nodeID, http.MethodGet, "/api/v1/query?key=k&"+query, ""); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("cut-off leader answered %s after its lease with %d, want 503: %s", query, w.Code, w.Body)
+		}
+	}
+
+	// Once deposed it knows no leader to send reads to
+	next := c.leader(term, rest...)
+	waitFor(t, 5*time.Second, "the old leader to step down", func() bool {
+		state, _ := old.GetState()
+		return state != "leader"
+	})
+	for _, bound := range []string{"500ms", "5"} {
+		w := c.serve(old.nodeID, http.MethodGet, "/api/v1/query?key=k&max_staleness="+bound, "")
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("deposed leader answered max_staleness=%s with %d, want 503: %s", bound, w.Code, w.Body)
+		} else if body := notLeaderBody(t, w); body["leader_id"] != "" {
+			t.Errorf("deposed leader names %q as leader while cut off", body["leader_id"])
+		}
+	}
+
+	c.network.Heal()
+	waitFor(t, 5*time.Second, "the old leader to learn the new one", func() bool {
+		id, _ := old.Leader()
+		return id == next.nodeID
+	})
+	w := c.serve(old.nodeID, http.MethodGet, "/api/v1/query?key=k", "")
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("old leader answered a linearizable read with %d after healing, want 307: %s", w.Code, w.Body)
+	}
+	if location, want := w.Header().Get("Location"), "http://"+apiAddr(next.nodeID)+"/api/v1/query?key=k"; location != want {
+		t.Errorf("Location = %q, want %q", location, want)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangeKind classifies how what the database recorded for a valid-time
+// period changed between two transaction times
+type ChangeKind string
+
+const (
+	// ChangeAdded means nothing was recorded for the period before and a
+	// value is now
+	ChangeAdded ChangeKind = "added"
+	// ChangeSuperseded means a different value replaced the one recorded
+	ChangeSuperseded ChangeKind = "superseded"
+	// ChangeRetracted means the value recorded was deleted
+	ChangeRetracted ChangeKind = "retracted"
+)
+
+// FactChange is one change in the database's knowledge of a key: the value
+// it recorded for [ValidStart, ValidEnd) as of the earlier transaction time,
+// and the one it recorded as of the later
+type FactChange struct {
+	Kind       ChangeKind    `json:"kind"`
+	ValidStart time.Time     `json:"valid_start"`
+	ValidEnd   time.Time     `json:"valid_end"`
+	OldValue   interface{}   `json:"old_value"`            // null for added facts
+	NewValue   interface{}   `json:"new_value"`            // null for retracted facts
+	RecordedAt time.Time     `json:"recorded_at"`          // transaction time of the write that made the change
+	ValueDiff  []ValueChange `json:"value_diff,omitempty"` // how the value changed, for superseded facts
+}
+
+// ValueChange is one difference between two JSON values, located by a JSON
+// Pointer (RFC 6901) into them
+type ValueChange struct {
+	Op   string      `json:"op"` // add, remove or replace
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"` // null for add
+	New  interface{} `json:"new"` // null for remove
+}
+
+// Diff returns how the database's knowledge of key changed between
+// transaction times t1 and t2, in valid-time order: the periods that gained
+// a value, the periods whose value was superseded by another, and the
+// periods whose value was retracted. Records split by a later write but
+// unchanged in value are not reported.
+func (db *DBEngine) Diff(key string, t1, t2 time.Time) []FactChange {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	records := db.data[key]
+
+	// What was known can only differ between boundaries of records current
+	// at either time
+	var bounds []time.Time
+	for _, rec := range records {
+		if rec.currentAt(t1) || rec.currentAt(t2) {
+			bounds = append(bounds, rec.ValidTimeStart, rec.ValidTimeEnd)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].Before(bounds[j]) })
+
+	changes := []FactChange{}
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if !start.Before(end) {
+			continue
+		}
+		change, changed := diffAt(records, t1, t2, start)
+		if !changed {
+			continue
+		}
+		change.ValidStart, change.ValidEnd = start, end
+
+		if n := len(changes); n > 0 {
+			last := &changes[n-1]
+			if last.ValidEnd.Equal(start) && last.Kind == change.Kind && last.RecordedAt.Equal(change.RecordedAt) &&
+				reflect.DeepEqual(last.OldValue, change.OldValue) && reflect.DeepEqual(last.NewValue, change.NewValue) {
+				last.ValidEnd = end
+				continue
+			}
+		}
+		if change.Kind == ChangeSuperseded {
+			change.ValueDiff = diffValues("", change.OldValue, change.NewValue)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// diffAt compares what was recorded for valid time t as of t1 and as of t2
+func diffAt(records []TemporalRecord, t1, t2, t time.Time) (FactChange, bool) {
+	before, hadValue := recordAt(records, t1, t)
+	hadValue = hadValue && !before.Deleted
+	after, hasRecord := recordAt(records, t2, t)
+	hasValue := hasRecord && !after.Deleted
+
+	var change FactChange
+	switch {
+	case !hadValue && hasValue:
+		change = FactChange{Kind: ChangeAdded, NewValue: after.Value}
+	case hadValue && !hasValue:
+		change = FactChange{Kind: ChangeRetracted, OldValue: before.Value}
+	case hadValue && hasValue && !reflect.DeepEqual(before.Value, after.Value):
+		change = FactChange{Kind: ChangeSuperseded, OldValue: before.Value, NewValue: after.Value}
+	default:
+		return FactChange{}, false
+	}
+
+	switch {
+	case hasRecord:
+		change.RecordedAt = recordedSince(records, t1, after, t)
+	case before.TransactionTimeEnd != nil:
+		change.RecordedAt = *before.TransactionTimeEnd
+	}
+	return change, true
+}
+
+// recordedSince returns the transaction time after t1 from which the
+// database has recorded what current says about valid time t. Every write
+// that changed what was known about t left a record covering t, so walking
+// back over those records finds it; a record split off by a later write
+// still dates from the write that first recorded its value.
+func recordedSince(records []TemporalRecord, t1 time.Time, current TemporalRecord, t time.Time) time.Time {
+	var txTimes []time.Time
+	for _, rec := range records {
+		if rec.ValidPeriod().Contains(t) && rec.TransactionTime.After(t1) && rec.TransactionTime.Before(current.TransactionTime) {
+			txTimes = append(txTimes, rec.TransactionTime)
+		}
+	}
+	sort.Slice(txTimes, func(i, j int) bool { return txTimes[i].After(txTimes[j]) })
+
+	since := current.TransactionTime
+	for _, txTime := range txTimes {
+		rec, found := recordAt(records, txTime, t)
+		if !found || rec.Deleted != current.Deleted || (!rec.Deleted && !reflect.DeepEqual(rec.Value, current.Value)) {
+			break
+		}
+		since = txTime
+	}
+	return since
+}
+
+// diffValues lists the differences between two decoded JSON values. Objects
+// are compared key by key and arrays index by index; anything else that
+// differs is replaced whole.
+func diffValues(path string, before, after interface{}) []ValueChange {
+	switch oldValue := before.(type) {
+	case map[string]interface{}:
+		newValue, ok := after.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(oldValue)+len(newValue))
+		for k := range oldValue {
+			keys = append(keys, k)
+		}
+		for k := range newValue {
+			if _, ok := oldValue[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		var changes []ValueChange
+		for _, k := range keys {
+			childPath := path + "/" + escapePointer(k)
+			o, inOld := oldValue[k]
+			n, inNew := newValue[k]
+			switch {
+			case !inOld:
+				changes = append(changes, ValueChange{Op: "add", Path: childPath, New: n})
+			case !inNew:
+				changes = append(changes, ValueChange{Op: "remove", Path: childPath, Old: o})
+			default:
+				changes = append(changes, diffValues(childPath, o, n)...)
+			}
+		}
+		return changes
+
+	case []interface{}:
+		newValue, ok := after.([]interface{})
+		if !ok {
+			break
+		}
+		var changes []ValueChange
+		for i := 0; i < len(oldValue) || i < len(newValue); i++ {
+			childPath := fmt.Sprintf("%s/%d", path, i)
+			switch {
+			case i >= len(oldValue):
+				changes = append(changes, ValueChange{Op: "add", Path: childPath, New: newValue[i]})
+			case i >= len(newValue):
+				changes = append(changes, ValueChange{Op: "remove", Path: childPath, Old: oldValue[i]})
+			default:
+				changes = append(changes, diffValues(childPath, oldValue[i], newValue[i])...)
+			}
+		}
+		return changes
+	}
+
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	return []ValueChange{{Op: "replace", Path: path, Old: before, New: after}}
+}
+
+// escapePointer escapes an object key for use in a JSON Pointer
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
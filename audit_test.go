@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffReportsChangedFacts(t *testing.T) {
+	db := newTestDB(t)
+	original := map[string]interface{}{"amount": 100.0, "tags": []interface{}{"list"}, "a/b": 1.0}
+	corrected := map[string]interface{}{"amount": 120.0, "tags": []interface{}{"list", "sale"}}
+
+	if err := db.InsertAt("price", original, date(time.January, 1), date(time.December, 1), date(time.February, 1)); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+	if err := db.InsertAt("price", corrected, date(time.March, 1), date(time.June, 1), date(time.April, 1)); err != nil {
+		t.Fatalf("InsertAt correction: %v", err)
+	}
+	if err := db.InsertAt("price", "closed", date(time.December, 1), date(time.December, 31), date(time.May, 1)); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+	if err := db.DeleteAt("price", date(time.August, 1), date(time.September, 1), date(time.June, 1)); err != nil {
+		t.Fatalf("DeleteAt: %v", err)
+	}
+
+	// The slices of the original left around the correction and the delete
+	// are unchanged and not reported
+	changes := db.Diff("price", date(time.March, 1), date(time.July, 1))
+	want := []FactChange{
+		{
+			Kind: ChangeSuperseded, ValidStart: date(time.March, 1), ValidEnd: date(time.June, 1),
+			OldValue: original, NewValue: corrected, RecordedAt: date(time.April, 1),
+			ValueDiff: []ValueChange{
+				{Op: "remove", Path: "/a~1b", Old: 1.0},
+				{Op: "replace", Path: "/amount", Old: 100.0, New: 120.0},
+				{Op: "add", Path: "/tags/1", New: "sale"},
+			},
+		},
+		{
+			Kind: ChangeRetracted, ValidStart: date(time.August, 1), ValidEnd: date(time.September, 1),
+			OldValue: original, RecordedAt: date(time.June, 1),
+		},
+		{
+			Kind: ChangeAdded, ValidStart: date(time.December, 1), ValidEnd: date(time.December, 31),
+			NewValue: "closed", RecordedAt: date(time.May, 1),
+		},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("Diff = %+v, want %+v", changes, want)
+	}
+
+	// Before anything was recorded, the slices of the original are additions
+	// dating from the original write, not from the writes that split them
+	changes = db.Diff("price", date(time.January, 1), date(time.July, 1))
+	if len(changes) != 5 {
+		t.Fatalf("Diff has %d changes, want 5: %+v", len(changes), changes)
+	}
+	if first := changes[0]; first.Kind != ChangeAdded || !first.ValidEnd.Equal(date(time.March, 1)) ||
+		!first.RecordedAt.Equal(date(time.February, 1)) {
+		t.Errorf("first change = %+v, want the original added over [Jan 1, Mar 1) at Feb 1", first)
+	}
+
+	if changes := db.Diff("price", date(time.July, 1), date(time.August, 1)); len(changes) != 0 {
+		t.Errorf("Diff with no writes in between = %+v, want none", changes)
+	}
+}
+
+func TestDiffMergesUnchangedSlices(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.InsertAt("rate", 5, date(time.January, 1), date(time.December, 1), date(time.February, 1)); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+	// Rewriting the same value splits the record without changing anything
+	if err := db.InsertAt("rate", 5, date(time.March, 1), date(time.June, 1), date(time.April, 1)); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+
+	changes := db.Diff("rate", date(time.January, 1), date(time.May, 1))
+	want := []FactChange{{
+		Kind: ChangeAdded, ValidStart: date(time.January, 1), ValidEnd: date(time.December, 1),
+		NewValue: 5, RecordedAt: date(time.February, 1),
+	}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("Diff = %+v, want %+v", changes, want)
+	}
+	if changes := db.Diff("rate", date(time.March, 1), date(time.May, 1)); len(changes) != 0 {
+		t.Errorf("Diff across a rewrite of the same value = %+v, want none", changes)
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after interface{}
+		want          []ValueChange
+	}{
+		{"equal", map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": 1.0}, nil},
+		{"scalar", 1.0, 2.0, []ValueChange{{Op: "replace", Path: "", Old: 1.0, New: 2.0}}},
+		{"type change", []interface{}{1.0}, "one", []ValueChange{{Op: "replace", Path: "", Old: []interface{}{1.0}, New: "one"}}},
+		{
+			"nested",
+			map[string]interface{}{"user": map[string]interface{}{"name": "ada", "~id": 1.0}},
+			map[string]interface{}{"user": map[string]interface{}{"name": "ada lovelace", "~id": 1.0}},
+			[]ValueChange{{Op: "replace", Path: "/user/name", Old: "ada", New: "ada lovelace"}},
+		},
+		{
+			"array shrinks",
+			[]interface{}{"a", "b", "c"},
+			[]interface{}{"a", "x"},
+			[]ValueChange{
+				{Op: "replace", Path: "/1", Old: "b", New: "x"},
+				{Op: "remove", Path: "/2", Old: "c"},
+			},
+		},
+		{
+			"escaped keys",
+			map[string]interface{}{"~id": 1.0},
+			map[string]interface{}{"~id": 2.0, "a/b": true},
+			[]ValueChange{
+				{Op: "add", Path: "/a~1b", New: true},
+				{Op: "replace", Path: "/~0id", Old: 1.0, New: 2.0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := diffValues("", tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffValues = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffEncodesNullAndFalseValues(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.InsertAt("flag", nil, date(time.January, 1), date(time.December, 1), date(time.February, 1)); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+	if err := db.InsertAt("flag", false, date(time.January, 1), date(time.December, 1), date(time.March, 1)); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+
+	changes := db.Diff("flag", date(time.February, 15), date(time.April, 1))
+	if len(changes) != 1 || changes[0].Kind != ChangeSuperseded {
+		t.Fatalf("Diff = %+v, want the null value superseded", changes)
+	}
+	encoded, err := json.Marshal(changes[0])
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, field := range []string{`"old_value":null`, `"new_value":false`, `"old":null`, `"new":false`} {
+		if !strings.Contains(string(encoded), field) {
+			t.Errorf("encoded change %s lacks %s", encoded, field)
+		}
+	}
+}
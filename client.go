@@ -1,3 +1,5 @@
+//go:build ignore
+
 // Client CLI utility for Chrono-DB
 // Build: go build -o chrono-client client.go
 // Usage: ./chrono-client <command> [options]
@@ -11,13 +13,29 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"text/tabwriter"
 )
 
 var (
-	baseURL = flag.String("url", "http://localhost:8080", "Chrono-DB API URL")
+	baseURL     = flag.String("url", "http://localhost:8080", "Chrono-DB API URL")
+	consistency = flag.String("consistency", "", "Read consistency: linearizable, lease or stale")
+	staleness   = flag.String("max-staleness", "", "Allow follower reads this far behind the leader (duration or entries)")
 )
 
+// httpClient follows the 307 redirects followers send for writes, which
+// point at the current leader
+var httpClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("stopped after %d redirects", len(via))
+		}
+		fmt.Fprintf(os.Stderr, "Redirected to leader at %s\n", req.URL.Host)
+		return nil
+	},
+}
+
 func main() {
 	flag.Parse()
 
@@ -38,6 +56,26 @@ func main() {
 		value := flag.Args()[2]
 		insertData(key, value)
 
+	case "correct":
+		if len(flag.Args()) < 5 {
+			fmt.Println("Usage: client correct <key> <value> <valid-start> <valid-end>")
+			os.Exit(1)
+		}
+		args := flag.Args()
+		correctData(args[1], args[2], args[3], args[4])
+
+	case "delete":
+		args := flag.Args()
+		if len(args) != 2 && len(args) != 4 {
+			fmt.Println("Usage: client delete <key> [<valid-start> <valid-end>]")
+			os.Exit(1)
+		}
+		validStart, validEnd := "", ""
+		if len(args) == 4 {
+			validStart, validEnd = args[2], args[3]
+		}
+		deleteData(args[1], validStart, validEnd)
+
 	case "query":
 		if len(flag.Args()) < 2 {
 			fmt.Println("Usage: client query <key>")
@@ -54,9 +92,74 @@ func main() {
 		key := flag.Args()[1]
 		getHistory(key)
 
+	case "range":
+		args := flag.Args()
+		if len(args) != 4 && len(args) != 5 {
+			fmt.Println("Usage: client range <key> <start> <end> [relation]")
+			os.Exit(1)
+		}
+		relation := ""
+		if len(args) == 5 {
+			relation = args[4]
+		}
+		queryRange(args[1], args[2], args[3], relation)
+
+	case "timeline":
+		args := flag.Args()
+		if len(args) != 2 && len(args) != 4 {
+			fmt.Println("Usage: client timeline <key> [<from> <to>]")
+			os.Exit(1)
+		}
+		params := url.Values{}
+		if len(args) == 4 {
+			params.Set("from", args[2])
+			params.Set("to", args[3])
+		}
+		getTimeline(args[1], params)
+
+	case "diff":
+		args := flag.Args()
+		if len(args) != 3 && len(args) != 4 {
+			fmt.Println("Usage: client diff <key> <t1> [t2]")
+			os.Exit(1)
+		}
+		params := url.Values{}
+		params.Set("t1", args[2])
+		if len(args) == 4 {
+			params.Set("t2", args[3])
+		}
+		getDiff(args[1], params)
+
 	case "status":
 		getStatus()
 
+	case "cluster":
+		showCluster()
+
+	case "members":
+		getMembers()
+
+	case "add-voter", "add-learner":
+		if len(flag.Args()) < 3 {
+			fmt.Printf("Usage: client %s <node-id> <raft-addr>\n", command)
+			os.Exit(1)
+		}
+		changeMembership(command, flag.Args()[1], flag.Args()[2])
+
+	case "promote", "remove":
+		if len(flag.Args()) < 2 {
+			fmt.Printf("Usage: client %s <node-id>\n", command)
+			os.Exit(1)
+		}
+		changeMembership(command, flag.Args()[1], "")
+
+	case "transfer-leader":
+		to := ""
+		if len(flag.Args()) > 1 {
+			to = flag.Args()[1]
+		}
+		transferLeader(to)
+
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
 		printUsage()
@@ -69,11 +172,27 @@ func printUsage() {
 	fmt.Println("\nUsage: client [options] <command> [args]")
 	fmt.Println("\nCommands:")
 	fmt.Println("  insert <key> <value>  - Insert a key-value pair")
+	fmt.Println("  correct <key> <value> <start> <end> - Replace a key's value for a valid-time period (RFC 3339 times)")
+	fmt.Println("  delete <key> [<start> <end>] - Retract a key's value, from now on or for a valid-time period")
 	fmt.Println("  query <key>          - Query current value for a key")
 	fmt.Println("  history <key>        - Get full history for a key")
+	fmt.Println("  range <key> <start> <end> [relation] - Records whose valid time stands in an Allen relation")
+	fmt.Println("                         to [start, end): before, meets, overlaps, starts, during, finishes,")
+	fmt.Println("                         equals, their inverses, or intersects (default)")
+	fmt.Println("  timeline <key> [<from> <to>] - Values a key had across valid time, merged into segments")
+	fmt.Println("  diff <key> <t1> [t2] - Facts added, superseded or retracted between two transaction times")
 	fmt.Println("  status               - Get cluster status")
+	fmt.Println("  cluster              - Show log positions and per-peer replication as a table")
+	fmt.Println("  members              - Show cluster voters and learners")
+	fmt.Println("  add-voter <id> <addr>   - Add a voting member (leader only)")
+	fmt.Println("  add-learner <id> <addr> - Add a non-voting member (leader only)")
+	fmt.Println("  promote <id>         - Promote a caught-up learner to voter")
+	fmt.Println("  remove <id>          - Remove a voter or learner")
+	fmt.Println("  transfer-leader [id] - Hand leadership to a voter (most up to date if omitted)")
 	fmt.Println("\nOptions:")
 	fmt.Println("  -url string          - API URL (default: http://localhost:8080)")
+	fmt.Println("  -consistency string  - Read consistency: linearizable (default), lease or stale")
+	fmt.Println("  -max-staleness string - Bounded follower reads, e.g. 2s or 100 (entries)")
 }
 
 func insertData(key, value string) {
@@ -88,7 +207,58 @@ func insertData(key, value string) {
 		os.Exit(1)
 	}
 
-	resp, err := http.Post(*baseURL+"/api/v1/insert", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := httpClient.Post(*baseURL+"/api/v1/insert", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Printf("Response: %s\n", string(body))
+}
+
+func correctData(key, value, validStart, validEnd string) {
+	data := map[string]interface{}{
+		"key":         key,
+		"value":       value,
+		"valid_start": validStart,
+		"valid_end":   validEnd,
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		fmt.Printf("Error marshaling data: %v\n", err)
+		os.Exit(1)
+	}
+
+	resp, err := httpClient.Post(*baseURL+"/api/v1/correct", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Printf("Response: %s\n", string(body))
+}
+
+func deleteData(key, validStart, validEnd string) {
+	data := map[string]interface{}{
+		"key": key,
+	}
+	if validStart != "" {
+		data["valid_start"] = validStart
+		data["valid_end"] = validEnd
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		fmt.Printf("Error marshaling data: %v\n", err)
+		os.Exit(1)
+	}
+
+	resp, err := httpClient.Post(*baseURL+"/api/v1/delete", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		fmt.Printf("Error making request: %v\n", err)
 		os.Exit(1)
@@ -100,7 +270,7 @@ func insertData(key, value string) {
 }
 
 func queryData(key string) {
-	resp, err := http.Get(fmt.Sprintf("%s/api/v1/query?key=%s", *baseURL, key))
+	resp, err := httpClient.Get(readURL("/api/v1/query", key, nil))
 	if err != nil {
 		fmt.Printf("Error making request: %v\n", err)
 		os.Exit(1)
@@ -122,8 +292,25 @@ func queryData(key string) {
 	}
 }
 
+// readURL builds the URL of a read endpoint for key, passing the requested
+// consistency level or staleness bound along
+func readURL(path, key string, extra url.Values) string {
+	params := url.Values{}
+	for name, values := range extra {
+		params[name] = values
+	}
+	params.Set("key", key)
+	if *consistency != "" {
+		params.Set("consistency", *consistency)
+	}
+	if *staleness != "" {
+		params.Set("max_staleness", *staleness)
+	}
+	return fmt.Sprintf("%s%s?%s", *baseURL, path, params.Encode())
+}
+
 func getHistory(key string) {
-	resp, err := http.Get(fmt.Sprintf("%s/api/v1/history?key=%s", *baseURL, key))
+	resp, err := httpClient.Get(readURL("/api/v1/history", key, nil))
 	if err != nil {
 		fmt.Printf("Error making request: %v\n", err)
 		os.Exit(1)
@@ -141,8 +328,110 @@ func getHistory(key string) {
 	}
 }
 
+func queryRange(key, start, end, relation string) {
+	params := url.Values{}
+	params.Set("start", start)
+	params.Set("end", end)
+	if relation != "" {
+		params.Set("relation", relation)
+	}
+
+	resp, err := httpClient.Get(readURL("/api/v1/temporal/range", key, params))
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error: %s", string(body))
+		os.Exit(1)
+	}
+	printJSON(body)
+}
+
+func getTimeline(key string, params url.Values) {
+	resp, err := httpClient.Get(readURL("/api/v1/timeline", key, params))
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error: %s", string(body))
+		os.Exit(1)
+	}
+	printJSON(body)
+}
+
+func getDiff(key string, params url.Values) {
+	resp, err := httpClient.Get(readURL("/api/v1/diff", key, params))
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error: %s", string(body))
+		os.Exit(1)
+	}
+	printJSON(body)
+}
+
 func getStatus() {
-	resp, err := http.Get(*baseURL + "/api/v1/status")
+	resp, err := httpClient.Get(*baseURL + "/api/v1/status")
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err == nil {
+		jsonStr, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(jsonStr))
+	} else {
+		fmt.Printf("Response: %s\n", string(body))
+	}
+}
+
+// clusterStatus is the part of /api/v1/status that showCluster renders
+type clusterStatus struct {
+	NodeID        string `json:"node_id"`
+	State         string `json:"raft_state"`
+	Term          int64  `json:"raft_term"`
+	Role          string `json:"raft_role"`
+	LeaderID      string `json:"leader_id"`
+	CommitIndex   int64  `json:"commit_index"`
+	LastApplied   int64  `json:"last_applied"`
+	LastLogIndex  int64  `json:"last_log_index"`
+	LogSize       int    `json:"log_size"`
+	SnapshotIndex int64  `json:"snapshot_index"`
+	Peers         []struct {
+		ID       string `json:"id"`
+		Addr     string `json:"addr"`
+		Role     string `json:"role"`
+		Progress *struct {
+			MatchIndex    int64 `json:"match_index"`
+			NextIndex     int64 `json:"next_index"`
+			Inflight      int   `json:"inflight"`
+			LastContactMS int64 `json:"last_contact_ms"`
+			Lag           int64 `json:"lag"`
+		} `json:"progress"`
+	} `json:"peers"`
+}
+
+// showCluster prints a node's log positions and, when it is the leader, how
+// far each peer has replicated
+func showCluster() {
+	resp, err := httpClient.Get(*baseURL + "/api/v1/status")
 	if err != nil {
 		fmt.Printf("Error making request: %v\n", err)
 		os.Exit(1)
@@ -150,7 +439,97 @@ func getStatus() {
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
+	var status clusterStatus
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &status) != nil {
+		fmt.Printf("Error: %s", string(body))
+		os.Exit(1)
+	}
+
+	leader := status.LeaderID
+	if leader == "" {
+		leader = "unknown"
+	}
+	fmt.Printf("Node %s: %s in term %d, leader %s\n", status.NodeID, status.State, status.Term, leader)
+	fmt.Printf("Commit %d, applied %d, last log index %d, %d entries after snapshot %d\n\n",
+		status.CommitIndex, status.LastApplied, status.LastLogIndex, status.LogSize, status.SnapshotIndex)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tROLE\tADDR\tMATCH\tNEXT\tLAG\tINFLIGHT\tLAST CONTACT")
+	fmt.Fprintf(w, "%s (self)\t%s\t-\t%d\t-\t-\t-\t-\n", status.NodeID, status.Role, status.LastLogIndex)
+	for _, p := range status.Peers {
+		if p.Progress == nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\t-\t-\n", p.ID, p.Role, p.Addr)
+			continue
+		}
+		contact := "never"
+		if p.Progress.LastContactMS >= 0 {
+			contact = fmt.Sprintf("%dms ago", p.Progress.LastContactMS)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n", p.ID, p.Role, p.Addr,
+			p.Progress.MatchIndex, p.Progress.NextIndex, p.Progress.Lag, p.Progress.Inflight, contact)
+	}
+	w.Flush()
+	if status.State != "leader" {
+		fmt.Printf("\nReplication progress is only known to the leader (%s)\n", leader)
+	}
+}
+
+func getMembers() {
+	resp, err := httpClient.Get(*baseURL + "/api/v1/admin/members")
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	printJSON(body)
+}
+
+func changeMembership(op, id, addr string) {
+	params := url.Values{}
+	params.Set("id", id)
+	if addr != "" {
+		params.Set("addr", addr)
+	}
+
+	resp, err := httpClient.Post(fmt.Sprintf("%s/api/v1/admin/%s?%s", *baseURL, op, params.Encode()), "application/json", nil)
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error: %s", string(body))
+		os.Exit(1)
+	}
+	printJSON(body)
+}
+
+func transferLeader(to string) {
+	params := url.Values{}
+	if to != "" {
+		params.Set("to", to)
+	}
+
+	resp, err := httpClient.Post(fmt.Sprintf("%s/api/v1/admin/transfer-leader?%s", *baseURL, params.Encode()), "application/json", nil)
+	if err != nil {
+		fmt.Printf("Error making request: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error: %s", string(body))
+		os.Exit(1)
+	}
+	printJSON(body)
+}
 
+func printJSON(body []byte) {
 	var result map[string]interface{}
 	if err := json.Unmarshal(body, &result); err == nil {
 		jsonStr, _ := json.MarshalIndent(result, "", "  ")
@@ -0,0 +1,47 @@
+package main
+
+import "time"
+
+// Clock is the source of time for RaftNode and DBEngine. Production code
+// uses the wall clock; the simulation tests substitute a virtual clock they
+// advance themselves.
+type Clock interface {
+	Now() time.Time
+	// After delivers the time on the returned channel once d has passed
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine once d has passed
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a pending AfterFunc call
+type Timer interface {
+	// Stop cancels the call, reporting whether it had not yet run
+	Stop() bool
+}
+
+// Ticker delivers ticks at a fixed interval
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
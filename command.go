@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CommandType identifies a state machine operation carried in the Raft log
+type CommandType string
+
+const (
+	// CmdInsert appends a new temporal record
+	CmdInsert CommandType = "insert"
+	// CmdCorrect records a retroactive correction for a valid-time period
+	CmdCorrect CommandType = "correct"
+	// CmdDelete retracts a fact for a valid-time period
+	CmdDelete CommandType = "delete"
+	// CmdCounterIncrement increments a grow-only CRDT counter
+	CmdCounterIncrement CommandType = "counter_increment"
+)
+
+// Command is a state machine operation replicated through Raft. Everything
+// that would otherwise differ between replicas, such as the transaction time
+// or the originating node, is fixed by the leader before the command is
+// appended to the log.
+type Command struct {
+	Type       CommandType `json:"type"`
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value,omitempty"`
+	ValidStart time.Time   `json:"valid_start"`
+	ValidEnd   time.Time   `json:"valid_end"`
+	TxTime     time.Time   `json:"tx_time"`
+	NodeID     string      `json:"node_id,omitempty"`
+	Delta      int64       `json:"delta,omitempty"`
+}
+
+// encodeCommand serializes a command for LogEntry.Command
+func encodeCommand(cmd Command) (json.RawMessage, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+	return data, nil
+}
+
+// decodeCommand parses LogEntry.Command
+func decodeCommand(data json.RawMessage) (Command, error) {
+	var cmd Command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return cmd, fmt.Errorf("failed to decode command: %w", err)
+	}
+	return cmd, nil
+}
+
+// CommittedCommand is a command together with the Raft log index it was
+// committed at
+type CommittedCommand struct {
+	Index   int64
+	Command Command
+}
+
+// applyCommands executes commands committed at increasing indexes against
+// the local state machine and returns the result of each. Database writes
+// share a single WAL sync.
+func applyCommands(db *DBEngine, crdtStore *CRDTStore, cmds []CommittedCommand) []error {
+	errs := make([]error, len(cmds))
+	var dbCmds []CommittedCommand
+	var dbPos []int
+	for i, c := range cmds {
+		switch c.Command.Type {
+		case CmdCounterIncrement:
+			// The CRDT store is rebuilt from the log on every start, so
+			// counter increments are always applied
+			crdtStore.IncrementCounter(c.Command.Key, c.Command.NodeID, c.Command.Delta)
+		default:
+			dbCmds = append(dbCmds, c)
+			dbPos = append(dbPos, i)
+		}
+	}
+	if len(dbCmds) > 0 {
+		for i, err := range db.ApplyBatch(dbCmds) {
+			errs[dbPos[i]] = err
+		}
+	}
+	return errs
+}
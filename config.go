@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config mirrors the layout of example_config.json
+type Config struct {
+	Cluster  ClusterConfig  `json:"cluster"`
+	Database DatabaseConfig `json:"database"`
+	Raft     RaftConfig     `json:"raft"`
+}
+
+// ClusterConfig lists the statically configured members of the cluster
+type ClusterConfig struct {
+	Nodes []NodeConfig `json:"nodes"`
+}
+
+// NodeConfig describes one cluster member
+type NodeConfig struct {
+	NodeID   string `json:"node_id"`
+	Host     string `json:"host,omitempty"`
+	HTTPPort int    `json:"http_port"`
+	RaftPort int    `json:"raft_port"`
+	DataDir  string `json:"data_dir"`
+}
+
+// DatabaseConfig holds storage engine settings
+type DatabaseConfig struct {
+	MaxHistoryEntries int    `json:"max_history_entries"`
+	SnapshotInterval  string `json:"snapshot_interval"`
+	CompactionEnabled bool   `json:"compaction_enabled"`
+	WALSyncPolicy     string `json:"wal_sync_policy"`
+	WALSyncIntervalMS int    `json:"wal_sync_interval_ms"`
+	WALSegmentSizeMB  int    `json:"wal_segment_size_mb"`
+}
+
+// RaftConfig holds consensus timing and batching settings
+type RaftConfig struct {
+	ElectionTimeoutMS   int   `json:"election_timeout_ms"`
+	HeartbeatIntervalMS int   `json:"heartbeat_interval_ms"`
+	SnapshotThreshold   int64 `json:"snapshot_threshold"`
+	MaxBatchSize        int   `json:"max_batch_size"`       // writes appended to the log with one fsync
+	MaxInflightAppends  int   `json:"max_inflight_appends"` // AppendEntries RPCs in flight per follower
+}
+
+// DefaultConfig returns the configuration used when no file is given
+func DefaultConfig() Config {
+	return Config{
+		Database: DatabaseConfig{
+			MaxHistoryEntries: 1000,
+			SnapshotInterval:  "1h",
+			CompactionEnabled: true,
+			WALSyncPolicy:     "always",
+			WALSyncIntervalMS: 100,
+			WALSegmentSizeMB:  64,
+		},
+		Raft: RaftConfig{
+			ElectionTimeoutMS:   1000,
+			HeartbeatIntervalMS: 500,
+			SnapshotThreshold:   10000,
+			MaxBatchSize:        maxAppendEntries,
+			MaxInflightAppends:  defaultInflightAppends,
+		},
+	}
+}
+
+// LoadConfig reads a JSON configuration file on top of the defaults
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	return cfg, nil
+}
+
+// CheckpointInterval returns how often the WAL is folded into a snapshot
+func (c DatabaseConfig) CheckpointInterval() (time.Duration, error) {
+	if c.SnapshotInterval == "" {
+		return time.Hour, nil
+	}
+	d, err := time.ParseDuration(c.SnapshotInterval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid snapshot_interval %q: %w", c.SnapshotInterval, err)
+	}
+	return d, nil
+}
+
+// WALOptions converts the database settings into write-ahead log options
+func (c DatabaseConfig) WALOptions() (WALOptions, error) {
+	policy, err := ParseSyncPolicy(c.WALSyncPolicy)
+	if err != nil {
+		return WALOptions{}, err
+	}
+	return WALOptions{
+		SyncPolicy:   policy,
+		SyncInterval: time.Duration(c.WALSyncIntervalMS) * time.Millisecond,
+		SegmentSize:  int64(c.WALSegmentSizeMB) * 1024 * 1024,
+	}, nil
+}
+
+// RaftAddr returns the host:port other nodes use to reach this node's Raft port
+func (n NodeConfig) RaftAddr() string {
+	host := n.Host
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s:%d", host, n.RaftPort)
+}
+
+// Members returns the Raft addresses of every configured node, including
+// self. A node that is not listed in the cluster section gets no static
+// configuration.
+func (c ClusterConfig) Members(self string) map[string]string {
+	members := make(map[string]string)
+	listed := false
+	for _, node := range c.Nodes {
+		if node.NodeID == self {
+			listed = true
+		}
+		members[node.NodeID] = node.RaftAddr()
+	}
+	if !listed {
+		return map[string]string{}
+	}
+	return members
+}
+
+// ElectionTimeout returns the base election timeout
+func (c RaftConfig) ElectionTimeout() time.Duration {
+	if c.ElectionTimeoutMS <= 0 {
+		return time.Second
+	}
+	return time.Duration(c.ElectionTimeoutMS) * time.Millisecond
+}
+
+// HeartbeatInterval returns how often the leader contacts its followers
+func (c RaftConfig) HeartbeatInterval() time.Duration {
+	if c.HeartbeatIntervalMS <= 0 {
+		return 500 * time.Millisecond
+	}
+	return time.Duration(c.HeartbeatIntervalMS) * time.Millisecond
+}
+
+// BatchSize returns how many concurrent writes the leader may append to its
+// log in one batch; 1 appends and fsyncs every write on its own
+func (c RaftConfig) BatchSize() int {
+	if c.MaxBatchSize <= 0 {
+		return maxAppendEntries
+	}
+	if c.MaxBatchSize > maxAppendEntries {
+		return maxAppendEntries
+	}
+	return c.MaxBatchSize
+}
+
+// InflightAppends returns how many AppendEntries RPCs the leader may have
+// outstanding to a follower; 1 waits for each reply before sending more
+func (c RaftConfig) InflightAppends() int {
+	if c.MaxInflightAppends <= 0 {
+		return defaultInflightAppends
+	}
+	return c.MaxInflightAppends
+}
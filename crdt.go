@@ -24,6 +24,12 @@ type LWWRegister struct {
 	NodeID    string      `json:"node_id"`
 }
 
+// CRDTState is a serializable copy of the whole store
+type CRDTState struct {
+	Counters map[string]GCounter    `json:"counters"`
+	LWW      map[string]LWWRegister `json:"lww"`
+}
+
 // NewCRDTStore creates a new CRDT store
 func NewCRDTStore() *CRDTStore {
 	return &CRDTStore{
@@ -121,3 +127,43 @@ func (c *CRDTStore) MergeLWW(key string, other LWWRegister) {
 		c.lww[key] = other
 	}
 }
+
+// Snapshot returns a deep copy of the store's state
+func (c *CRDTStore) Snapshot() CRDTState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	state := CRDTState{
+		Counters: make(map[string]GCounter, len(c.gcounter)),
+		LWW:      make(map[string]LWWRegister, len(c.lww)),
+	}
+	for key, gc := range c.gcounter {
+		counts := make(map[string]int64, len(gc.NodeCounts))
+		for nodeID, count := range gc.NodeCounts {
+			counts[nodeID] = count
+		}
+		state.Counters[key] = GCounter{NodeCounts: counts}
+	}
+	for key, reg := range c.lww {
+		state.LWW[key] = reg
+	}
+	return state
+}
+
+// Restore replaces the store's state with a snapshot
+func (c *CRDTStore) Restore(state CRDTState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gcounter = make(map[string]GCounter, len(state.Counters))
+	for key, gc := range state.Counters {
+		if gc.NodeCounts == nil {
+			gc.NodeCounts = make(map[string]int64)
+		}
+		c.gcounter[key] = gc
+	}
+	c.lww = make(map[string]LWWRegister, len(state.LWW))
+	for key, reg := range state.LWW {
+		c.lww[key] = reg
+	}
+}
@@ -2,64 +2,296 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
+// ErrWALWrite is returned when a mutation could not be written to the
+// write-ahead log. Unlike a command that fails validation, which fails the
+// same way on every replica, it is lost on this replica alone.
+var ErrWALWrite = errors.New("failed to append to WAL")
+
 // DBEngine implements bitemporal database functionality
 type DBEngine struct {
-	mu       sync.RWMutex
-	data     map[string][]TemporalRecord
-	dataDir  string
+	mu            sync.RWMutex
+	data          map[string][]TemporalRecord
+	dataDir       string
+	wal           *WAL
+	checkpointLSN uint64
+	appliedIndex  int64     // Raft index of the last command applied
+	lastTxTime    time.Time // latest transaction time of any record
+	compact       bool
+	clock         Clock
+	stopCh        chan struct{}
+	doneCh        chan struct{}
 }
 
 // TemporalRecord represents a bitemporal data record
 type TemporalRecord struct {
-	Key              string                 `json:"key"`
-	Value            interface{}            `json:"value"`
-	ValidTimeStart   time.Time              `json:"valid_time_start"`
-	ValidTimeEnd     time.Time              `json:"valid_time_end"`
-	TransactionTime  time.Time              `json:"transaction_time"`
-	Metadata         map[string]interface{} `json:"metadata,omitempty"`
+	Key                string                 `json:"key"`
+	Value              interface{}            `json:"value"`
+	ValidTimeStart     time.Time              `json:"valid_time_start"`
+	ValidTimeEnd       time.Time              `json:"valid_time_end"`
+	TransactionTime    time.Time              `json:"transaction_time"`
+	TransactionTimeEnd *time.Time             `json:"transaction_time_end,omitempty"` // when a later write superseded the record; nil while it is current
+	Deleted            bool                   `json:"deleted,omitempty"`              // tombstone: the key had no value during the period
+	Metadata           map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// walRecord is a single logical mutation stored in the write-ahead log
+type walRecord struct {
+	Op     string         `json:"op"`
+	Index  int64          `json:"index,omitempty"`
+	Record TemporalRecord `json:"record"`
+}
+
+// snapshotData is the on-disk layout of a checkpoint
+type snapshotData struct {
+	CheckpointLSN uint64                      `json:"checkpoint_lsn"`
+	AppliedIndex  int64                       `json:"applied_index,omitempty"`
+	Data          map[string][]TemporalRecord `json:"data"`
 }
 
 // NewDBEngine creates a new database engine instance
-func NewDBEngine(dataDir string) (*DBEngine, error) {
+func NewDBEngine(dataDir string, cfg DatabaseConfig) (*DBEngine, error) {
+	return newDBEngine(dataDir, cfg, realClock{})
+}
+
+// newDBEngine creates a database engine that takes its time from clock
+func newDBEngine(dataDir string, cfg DatabaseConfig, clock Clock) (*DBEngine, error) {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	walOpts, err := cfg.WALOptions()
+	if err != nil {
+		return nil, err
+	}
+	interval, err := cfg.CheckpointInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := OpenWAL(filepath.Join(dataDir, "wal"), walOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+
 	db := &DBEngine{
 		data:    make(map[string][]TemporalRecord),
 		dataDir: dataDir,
+		wal:     wal,
+		compact: cfg.CompactionEnabled,
+		clock:   clock,
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
 	}
 
 	// Load existing data
 	if err := db.loadData(); err != nil {
+		wal.Close()
 		return nil, fmt.Errorf("failed to load data: %w", err)
 	}
 
+	go db.runCheckpoints(interval)
 	return db, nil
 }
 
 // Insert adds a new temporal record
 func (db *DBEngine) Insert(key string, value interface{}, validStart, validEnd time.Time) error {
+	return db.InsertAt(key, value, validStart, validEnd, db.clock.Now())
+}
+
+// InsertAt adds a new temporal record with an explicit transaction time, so
+// that replicas applying the same command store identical records. Parts of
+// current records the new period overlaps are superseded, as with Correct.
+func (db *DBEngine) InsertAt(key string, value interface{}, validStart, validEnd, txTime time.Time) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	record := TemporalRecord{
+	return db.insert(TemporalRecord{
 		Key:             key,
 		Value:           value,
 		ValidTimeStart:  validStart,
 		ValidTimeEnd:    validEnd,
-		TransactionTime: time.Now(),
+		TransactionTime: txTime,
+	}, 0)
+}
+
+// Delete retracts the key's value for the valid-time period [validStart,
+// validEnd). The retraction is a tombstone recorded at the current
+// transaction time, so queries as of earlier times still see the value.
+func (db *DBEngine) Delete(key string, validStart, validEnd time.Time) error {
+	return db.DeleteAt(key, validStart, validEnd, db.clock.Now())
+}
+
+// DeleteAt retracts the key's value for a valid-time period with an
+// explicit transaction time
+func (db *DBEngine) DeleteAt(key string, validStart, validEnd, txTime time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.insert(TemporalRecord{
+		Key:             key,
+		ValidTimeStart:  validStart,
+		ValidTimeEnd:    validEnd,
+		TransactionTime: txTime,
+		Deleted:         true,
+	}, 0)
+}
+
+// Apply executes a command committed at the given Raft log index. Commands at
+// or below AppliedIndex were already applied before a restart and are skipped.
+func (db *DBEngine) Apply(index int64, cmd Command) error {
+	return db.ApplyBatch([]CommittedCommand{{Index: index, Command: cmd}})[0]
+}
+
+// ApplyBatch executes commands committed at increasing Raft log indexes and
+// returns the result of each. Their WAL records are written together, with
+// a single sync; if that fails with ErrWALWrite none of them is applied.
+func (db *DBEngine) ApplyBatch(cmds []CommittedCommand) []error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	errs := make([]error, len(cmds))
+	var records []walRecord
+	var logged []int
+	for i, c := range cmds {
+		if c.Index <= db.appliedIndex {
+			continue
+		}
+		record, err := commandRecord(c.Command)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		records = append(records, walRecord{Op: "put", Index: c.Index, Record: record})
+		logged = append(logged, i)
 	}
 
-	db.data[key] = append(db.data[key], record)
-	return db.persistData()
+	if err := db.logRecords(records); err != nil {
+		for _, i := range logged {
+			errs[i] = err
+		}
+		return errs
+	}
+	for _, rec := range records {
+		db.put(rec.Record)
+		if rec.Index > db.appliedIndex {
+			db.appliedIndex = rec.Index
+		}
+	}
+	return errs
+}
+
+// commandRecord builds the record a command stores
+func commandRecord(cmd Command) (TemporalRecord, error) {
+	switch cmd.Type {
+	case CmdInsert, CmdCorrect, CmdDelete:
+	default:
+		return TemporalRecord{}, fmt.Errorf("unknown command type %q", cmd.Type)
+	}
+	if !cmd.ValidEnd.After(cmd.ValidStart) {
+		return TemporalRecord{}, fmt.Errorf("%w: valid time ends at %s, not after its start at %s",
+			ErrEmptyPeriod, cmd.ValidEnd.Format(time.RFC3339), cmd.ValidStart.Format(time.RFC3339))
+	}
+
+	// All three replace what was recorded for the period: a correction is
+	// an insert into the past, and a delete stores a tombstone
+	record := TemporalRecord{
+		Key:             cmd.Key,
+		ValidTimeStart:  cmd.ValidStart,
+		ValidTimeEnd:    cmd.ValidEnd,
+		TransactionTime: cmd.TxTime,
+	}
+	if cmd.Type == CmdDelete {
+		record.Deleted = true
+	} else {
+		record.Value = cmd.Value
+	}
+	return record, nil
+}
+
+// AppliedIndex returns the Raft index of the last command applied
+func (db *DBEngine) AppliedIndex() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.appliedIndex
+}
+
+// insert logs and stores a record. Callers must hold db.mu.
+func (db *DBEngine) insert(record TemporalRecord, index int64) error {
+	if !record.ValidTimeEnd.After(record.ValidTimeStart) {
+		return ErrEmptyPeriod
+	}
+	if err := db.logRecord(walRecord{Op: "put", Index: index, Record: record}); err != nil {
+		return err
+	}
+	db.put(record)
+	if index > db.appliedIndex {
+		db.appliedIndex = index
+	}
+	return nil
+}
+
+// logRecord appends a mutation to the write-ahead log before it is applied
+func (db *DBEngine) logRecord(rec walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode WAL record: %w", err)
+	}
+	if _, err := db.wal.Append(payload); err != nil {
+		return fmt.Errorf("%w: %v", ErrWALWrite, err)
+	}
+	return nil
+}
+
+// logRecords appends several mutations to the write-ahead log with a single
+// write and sync
+func (db *DBEngine) logRecords(recs []walRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	payloads := make([][]byte, len(recs))
+	for i, rec := range recs {
+		payload, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("failed to encode WAL record: %w", err)
+		}
+		payloads[i] = payload
+	}
+	if _, err := db.wal.AppendBatch(payloads); err != nil {
+		return fmt.Errorf("%w: %v", ErrWALWrite, err)
+	}
+	return nil
+}
+
+// replayRecord applies a mutation read back from the write-ahead log
+func (db *DBEngine) replayRecord(lsn uint64, payload []byte) error {
+	var rec walRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return fmt.Errorf("failed to decode WAL record %d: %w", lsn, err)
+	}
+
+	switch rec.Op {
+	case "insert":
+		// Written before records superseded each other
+		db.data[rec.Record.Key] = append(db.data[rec.Record.Key], rec.Record)
+		db.observeTxTime(rec.Record.TransactionTime)
+	case "put":
+		db.put(rec.Record)
+	default:
+		return fmt.Errorf("unknown WAL operation %q at LSN %d", rec.Op, lsn)
+	}
+	if rec.Index > db.appliedIndex {
+		db.appliedIndex = rec.Index
+	}
+	return nil
 }
 
 // QueryTemporal performs bitemporal queries
@@ -67,30 +299,75 @@ func (db *DBEngine) QueryTemporal(key string, asOfTime, validTime time.Time) (in
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	records, exists := db.data[key]
-	if !exists {
+	rec, found := recordAt(db.data[key], asOfTime, validTime)
+	if !found || rec.Deleted {
 		return nil, false
 	}
+	return rec.Value, true
+}
 
-	// Find the record valid at the specified times
+// recordAt finds the record, possibly a tombstone, that was current at
+// transaction time asOf and valid at validTime. Records written before
+// writes superseded each other may overlap; the latest one wins.
+func recordAt(records []TemporalRecord, asOf, validTime time.Time) (TemporalRecord, bool) {
 	for i := len(records) - 1; i >= 0; i-- {
 		rec := records[i]
 		// Check transaction time (as-of time)
-		if rec.TransactionTime.After(asOfTime) {
+		if !rec.currentAt(asOf) {
 			continue
 		}
 		// Check valid time
-		if validTime.After(rec.ValidTimeStart) && validTime.Before(rec.ValidTimeEnd) {
-			return rec.Value, true
+		if rec.ValidPeriod().Contains(validTime) {
+			return rec, true
 		}
 	}
-
-	return nil, false
+	return TemporalRecord{}, false
 }
 
 // QueryCurrent returns the current value for a key
 func (db *DBEngine) QueryCurrent(key string) (interface{}, bool) {
-	return db.QueryTemporal(key, time.Now(), time.Now())
+	return db.QueryTemporal(key, db.ReadTime(), db.clock.Now())
+}
+
+// ReadTime returns the transaction time reads of the current state are made
+// as of: the local clock, or the transaction time of the latest record if
+// that is later. Transaction times come from the leader's clock and may run
+// ahead of this node's under skew, a clock step or a burst of writes, and a
+// read as of the local clock alone would miss those records.
+func (db *DBEngine) ReadTime() time.Time {
+	now := db.clock.Now()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.lastTxTime.After(now) {
+		return db.lastTxTime
+	}
+	return now
+}
+
+// LastTxTime returns the latest transaction time of any record
+func (db *DBEngine) LastTxTime() time.Time {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lastTxTime
+}
+
+// observeTxTime keeps lastTxTime up to date as records are added. Callers
+// must hold db.mu.
+func (db *DBEngine) observeTxTime(txTime time.Time) {
+	if txTime.After(db.lastTxTime) {
+		db.lastTxTime = txTime
+	}
+}
+
+// resetTxTime recomputes lastTxTime after the dataset was replaced. Callers
+// must hold db.mu.
+func (db *DBEngine) resetTxTime() {
+	db.lastTxTime = time.Time{}
+	for _, records := range db.data {
+		for _, rec := range records {
+			db.observeTxTime(rec.TransactionTime)
+		}
+	}
 }
 
 // GetHistory returns all historical records for a key
@@ -109,37 +386,200 @@ func (db *DBEngine) GetHistory(key string) []TemporalRecord {
 	return history
 }
 
-// persistData saves data to disk
-func (db *DBEngine) persistData() error {
-	dataFile := filepath.Join(db.dataDir, "chrono_db.json")
-	file, err := os.Create(dataFile)
-	if err != nil {
-		return fmt.Errorf("failed to create data file: %w", err)
+// SnapshotData returns a copy of every record together with the Raft index
+// of the last command applied, for building a Raft snapshot
+func (db *DBEngine) SnapshotData() (map[string][]TemporalRecord, int64) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	data := make(map[string][]TemporalRecord, len(db.data))
+	for key, records := range db.data {
+		data[key] = append([]TemporalRecord(nil), records...)
+	}
+	return data, db.appliedIndex
+}
+
+// Restore replaces the whole dataset with the contents of a Raft snapshot
+// taken at appliedIndex and checkpoints it immediately
+func (db *DBEngine) Restore(data map[string][]TemporalRecord, appliedIndex int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if data == nil {
+		data = make(map[string][]TemporalRecord)
+	}
+	db.data = data
+	db.appliedIndex = appliedIndex
+	db.resetTxTime()
+	return db.checkpointLocked(true)
+}
+
+// Checkpoint writes the full dataset to disk and drops WAL segments it covers
+func (db *DBEngine) Checkpoint() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.checkpointLocked(false)
+}
+
+// checkpointLocked writes a checkpoint; force writes one even when no WAL
+// records were added since the last. Callers must hold db.mu.
+func (db *DBEngine) checkpointLocked(force bool) error {
+	lsn := db.wal.LastLSN()
+	if lsn == db.checkpointLSN && !force {
+		return nil
 	}
-	defer file.Close()
+	if err := db.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	if err := db.persistData(lsn); err != nil {
+		return err
+	}
+	previous := db.checkpointLSN
+	db.checkpointLSN = lsn
+
+	if err := db.wal.Rotate(); err != nil {
+		return err
+	}
+	// Keep the segments the previous checkpoint needs in case the new one
+	// turns out to be unreadable on the next start.
+	if db.compact {
+		return db.wal.RemoveBefore(previous + 1)
+	}
+	return nil
+}
+
+// runCheckpoints periodically folds the WAL into a snapshot
+func (db *DBEngine) runCheckpoints(interval time.Duration) {
+	defer close(db.doneCh)
+	ticker := db.clock.NewTicker(interval)
+	defer ticker.Stop()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(db.data)
+	for {
+		select {
+		case <-db.stopCh:
+			return
+		case <-ticker.C():
+			if err := db.Checkpoint(); err != nil {
+				log.Printf("Checkpoint failed: %v\n", err)
+			}
+		}
+	}
 }
 
-// loadData loads data from disk
+// persistData atomically saves data to disk, keeping the previous checkpoint
+func (db *DBEngine) persistData(lsn uint64) error {
+	payload, err := json.Marshal(snapshotData{CheckpointLSN: lsn, AppliedIndex: db.appliedIndex, Data: db.data})
+	if err != nil {
+		return fmt.Errorf("failed to encode data file: %w", err)
+	}
+	return writeSnapshotFile(filepath.Join(db.dataDir, "chrono_db.json"), payload, true)
+}
+
+// loadData loads the last checkpoint from disk and replays the WAL after it
 func (db *DBEngine) loadData() error {
+	if err := db.loadSnapshot(); err != nil {
+		return err
+	}
+
+	// A checkpoint newer than every WAL segment means the log directory was
+	// lost; never hand out LSNs the checkpoint already claims to contain.
+	if err := db.wal.AdvanceTo(db.checkpointLSN + 1); err != nil {
+		return err
+	}
+	if first := db.wal.FirstLSN(); first > db.checkpointLSN+1 {
+		return fmt.Errorf("WAL starts at LSN %d but checkpoint only covers up to %d; records are missing",
+			first, db.checkpointLSN)
+	}
+
+	return db.wal.Replay(db.checkpointLSN, db.replayRecord)
+}
+
+// loadSnapshot restores the newest readable checkpoint, falling back to the
+// previous one when chrono_db.json is missing or corrupt
+func (db *DBEngine) loadSnapshot() error {
 	dataFile := filepath.Join(db.dataDir, "chrono_db.json")
-	file, err := os.Open(dataFile)
+	snap, err := readCheckpoint(dataFile)
+	if err == nil {
+		db.installCheckpoint(snap)
+		return nil
+	}
+	missing := errors.Is(err, os.ErrNotExist)
+	if !missing && !errors.Is(err, ErrSnapshotCorrupt) {
+		return err
+	}
+
+	prev, prevErr := readCheckpoint(dataFile + ".prev")
+	if prevErr == nil {
+		if missing {
+			log.Printf("Data file missing, starting from previous checkpoint (LSN %d)\n", prev.CheckpointLSN)
+		} else {
+			log.Printf("Warning: %v; recovering from previous checkpoint (LSN %d)\n", err, prev.CheckpointLSN)
+		}
+		db.installCheckpoint(prev)
+		return nil
+	}
+
+	prevMissing := errors.Is(prevErr, os.ErrNotExist)
+	switch {
+	case missing && prevMissing:
+		return nil // No data file yet, start fresh
+	case missing:
+		return fmt.Errorf("data file missing and previous checkpoint unusable: %w", prevErr)
+	case prevMissing:
+		return fmt.Errorf("%w; no previous checkpoint to recover from, refusing to start", err)
+	}
+	return fmt.Errorf("%w; previous checkpoint also unusable (%v), refusing to start", err, prevErr)
+}
+
+// installCheckpoint replaces the in-memory state with a loaded checkpoint
+func (db *DBEngine) installCheckpoint(snap snapshotData) {
+	if snap.Data != nil {
+		db.data = snap.Data
+	}
+	db.checkpointLSN = snap.CheckpointLSN
+	db.appliedIndex = snap.AppliedIndex
+	db.resetTxTime()
+}
+
+// readCheckpoint reads and decodes a checkpoint file. Version 0 files are the
+// plain JSON written before snapshots had a header, either the bare record map
+// or the {checkpoint_lsn, data} layout.
+func readCheckpoint(path string) (snapshotData, error) {
+	var snap snapshotData
+	payload, version, err := readSnapshotFile(path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // No data file yet, start fresh
+		return snap, err
+	}
+
+	if version == 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return snap, fmt.Errorf("%w: %s: %v", ErrSnapshotCorrupt, path, err)
+		}
+		_, hasLSN := fields["checkpoint_lsn"]
+		_, hasData := fields["data"]
+		if !hasLSN || !hasData {
+			if err := json.Unmarshal(payload, &snap.Data); err != nil {
+				return snap, fmt.Errorf("%w: %s: %v", ErrSnapshotCorrupt, path, err)
+			}
+			return snap, nil
 		}
-		return fmt.Errorf("failed to open data file: %w", err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	return decoder.Decode(&db.data)
+	if err := json.Unmarshal(payload, &snap); err != nil {
+		return snap, fmt.Errorf("%w: %s: %v", ErrSnapshotCorrupt, path, err)
+	}
+	return snap, nil
 }
 
 // Close closes the database
 func (db *DBEngine) Close() error {
-	return db.persistData()
+	close(db.stopCh)
+	<-db.doneCh
+
+	err := db.Checkpoint()
+	if cerr := db.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
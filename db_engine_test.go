@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openDB opens the engine in dir; the test closes or crashes it
+func openDB(t *testing.T, dir string, cfg DatabaseConfig) *DBEngine {
+	t.Helper()
+	db, err := NewDBEngine(dir, cfg)
+	if err != nil {
+		t.Fatalf("NewDBEngine: %v", err)
+	}
+	return db
+}
+
+// crash stops the engine the way a power cut would: without the checkpoint
+// Close takes
+func crash(db *DBEngine) {
+	close(db.stopCh)
+	<-db.doneCh
+	db.wal.Close()
+}
+
+// mustInsert stores value for key from January on
+func mustInsert(t *testing.T, db *DBEngine, key string, value interface{}) {
+	t.Helper()
+	if err := db.Insert(key, value, date(time.January, 1), endOfTime); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+}
+
+// mustCheckpoint checkpoints the engine
+func mustCheckpoint(t *testing.T, db *DBEngine) {
+	t.Helper()
+	if err := db.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+}
+
+// assertValues checks the current value of every key in want
+func assertValues(t *testing.T, db *DBEngine, want map[string]interface{}) {
+	t.Helper()
+	for key, value := range want {
+		if got, found := db.QueryCurrent(key); !found || got != value {
+			t.Errorf("%s = %v (found %v), want %v", key, got, found, value)
+		}
+	}
+}
+
+func TestApplyBatchReportsWALWriteFailures(t *testing.T) {
+	db := newTestDB(t)
+	put := func(value interface{}, start, end time.Time) Command {
+		return Command{Type: CmdInsert, Key: "k", Value: value, ValidStart: start, ValidEnd: end, TxTime: time.Now()}
+	}
+	if err := db.Apply(1, put("first", date(time.January, 1), endOfTime)); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	db.wal.Close()
+	errs := db.ApplyBatch([]CommittedCommand{
+		{Index: 2, Command: put("second", date(time.January, 1), endOfTime)},
+		{Index: 3, Command: put("empty", date(time.March, 1), date(time.March, 1))},
+	})
+	if !errors.Is(errs[0], ErrWALWrite) {
+		t.Errorf("unlogged command returned %v, want ErrWALWrite", errs[0])
+	}
+	// Invalid everywhere, so not a reason to stop the replica
+	if !errors.Is(errs[1], ErrEmptyPeriod) || errors.Is(errs[1], ErrWALWrite) {
+		t.Errorf("invalid command returned %v, want ErrEmptyPeriod", errs[1])
+	}
+	if index := db.AppliedIndex(); index != 1 {
+		t.Errorf("applied index moved to %d past a command that was not logged, want 1", index)
+	}
+	if got, _ := db.QueryCurrent("k"); got != "first" {
+		t.Errorf("current value = %v, want first", got)
+	}
+}
+
+func TestReplaysWALOnTopOfCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, DefaultConfig().Database)
+	insert := func(value interface{}, start time.Time, tx time.Time) Command {
+		return Command{Type: CmdInsert, Key: "price", Value: value, ValidStart: start, ValidEnd: endOfTime, TxTime: tx}
+	}
+	if err := db.Apply(1, insert(100.0, date(time.January, 1), date(time.February, 1))); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	mustCheckpoint(t, db)
+	// Logged after the checkpoint: a correction that splits the record
+	correction := insert(120.0, date(time.March, 1), date(time.April, 1))
+	if err := db.Apply(2, correction); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	history := db.GetHistory("price")
+	crash(db)
+
+	db = openDB(t, dir, DefaultConfig().Database)
+	defer db.Close()
+	if db.checkpointLSN != 1 {
+		t.Fatalf("loaded checkpoint at LSN %d, want 1", db.checkpointLSN)
+	}
+	if got := db.GetHistory("price"); !reflect.DeepEqual(got, history) {
+		t.Fatalf("history after recovery = %+v, want %+v", got, history)
+	}
+	if index := db.AppliedIndex(); index != 2 {
+		t.Fatalf("applied index after recovery = %d, want 2", index)
+	}
+	// Raft hands the entry over again; it must not be applied twice
+	if err := db.Apply(2, correction); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := len(db.GetHistory("price")); got != len(history) {
+		t.Errorf("re-applying entry 2 left %d records, want %d", got, len(history))
+	}
+}
+
+func TestCheckpointCompactsWAL(t *testing.T) {
+	for _, tt := range []struct {
+		compact bool
+		want    []uint64
+	}{
+		// Segments the previous checkpoint needs are kept in case the
+		// newest turns out unreadable
+		{true, []uint64{2, 3}},
+		{false, []uint64{1, 2, 3}},
+	} {
+		cfg := DefaultConfig().Database
+		cfg.CompactionEnabled = tt.compact
+		dir := t.TempDir()
+		db := openDB(t, dir, cfg)
+		mustInsert(t, db, "x", 1) // LSN 1
+		mustCheckpoint(t, db)
+		mustInsert(t, db, "y", 2) // LSN 2
+		mustCheckpoint(t, db)
+
+		segments, err := listSegments(filepath.Join(dir, "wal"))
+		if err != nil {
+			t.Fatalf("listSegments: %v", err)
+		}
+		if !reflect.DeepEqual(segments, tt.want) {
+			t.Errorf("compaction %v: segments start at LSNs %v, want %v", tt.compact, segments, tt.want)
+		}
+		db.Close()
+	}
+}
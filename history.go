@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// History event types. Every operation is an invoke followed by one of ok
+// (it took effect and returned the recorded result), fail (it certainly did
+// not take effect) or info (its outcome is unknown, as after a timeout).
+const (
+	EventInvoke = "invoke"
+	EventOk     = "ok"
+	EventFail   = "fail"
+	EventInfo   = "info"
+)
+
+// maxReportedOps caps how many operations a failed check prints
+const maxReportedOps = 50
+
+// History operations
+const (
+	OpInsert = "insert"
+	OpQuery  = "query"
+)
+
+// HistoryEvent is one step of a client operation in a recorded history
+type HistoryEvent struct {
+	Type    string      `json:"type"`
+	Process int         `json:"process"`
+	Op      string      `json:"op"`
+	Key     string      `json:"key"`
+	Value   interface{} `json:"value,omitempty"`
+	Found   bool        `json:"found,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// HistoryRecorder records the invocations and completions of operations
+// made by concurrent client processes. Each process runs one operation at a
+// time, so a completion belongs to the process's last invocation.
+type HistoryRecorder struct {
+	mu      sync.Mutex
+	events  []HistoryEvent
+	pending map[int]HistoryEvent
+}
+
+// NewHistoryRecorder creates an empty recorder
+func NewHistoryRecorder() *HistoryRecorder {
+	return &HistoryRecorder{pending: make(map[int]HistoryEvent)}
+}
+
+// Invoke records that process started op on key. value is the value being
+// inserted; it is ignored for queries.
+func (h *HistoryRecorder) Invoke(process int, op, key string, value interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	event := HistoryEvent{Type: EventInvoke, Process: process, Op: op, Key: key, Time: time.Now()}
+	if op == OpInsert {
+		event.Value = value
+	}
+	h.pending[process] = event
+	h.events = append(h.events, event)
+}
+
+// Complete records the outcome of process's current operation. For a
+// successful query value and found are what it returned.
+func (h *HistoryRecorder) Complete(process int, eventType string, value interface{}, found bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	invoke, ok := h.pending[process]
+	if !ok {
+		return
+	}
+	delete(h.pending, process)
+
+	event := HistoryEvent{Type: eventType, Process: process, Op: invoke.Op, Key: invoke.Key, Value: invoke.Value, Time: time.Now()}
+	if invoke.Op == OpQuery && eventType == EventOk {
+		event.Value, event.Found = value, found
+	}
+	h.events = append(h.events, event)
+}
+
+// Events returns the recorded history in order
+func (h *HistoryRecorder) Events() []HistoryEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HistoryEvent(nil), h.events...)
+}
+
+// WriteFile stores the history as one JSON event per line
+func (h *HistoryRecorder) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create history file: %w", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, event := range h.Events() {
+		if err := enc.Encode(event); err != nil {
+			return fmt.Errorf("failed to write history: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return f.Sync()
+}
+
+// ReadHistory loads a history written by WriteFile
+func ReadHistory(path string) ([]HistoryEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	var events []HistoryEvent
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var event HistoryEvent
+		if err := dec.Decode(&event); err != nil {
+			return nil, fmt.Errorf("failed to read history event %d: %w", len(events)+1, err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// LinearizabilityResult is the verdict of CheckLinearizable. When the
+// history is not linearizable, Key names a key whose operations cannot be
+// ordered and Ops lists them.
+type LinearizabilityResult struct {
+	Linearizable bool
+	Key          string
+	Ops          []string
+}
+
+func (r LinearizabilityResult) String() string {
+	if r.Linearizable {
+		return "history is linearizable"
+	}
+	ops := r.Ops
+	more := ""
+	if len(ops) > maxReportedOps {
+		ops, more = ops[:maxReportedOps], fmt.Sprintf("\n  ... and %d more", len(r.Ops)-maxReportedOps)
+	}
+	return fmt.Sprintf("history is not linearizable: no valid order for the operations on key %q:\n  %s%s",
+		r.Key, strings.Join(ops, "\n  "), more)
+}
+
+// linOp is a completed or possibly completed operation on one key. Calls
+// and returns are positions in the history; ret is -1 while unknown.
+type linOp struct {
+	call   int
+	ret    int
+	insert bool
+	value  string
+	found  bool
+}
+
+func (op linOp) String() string {
+	ret := "?"
+	if op.ret >= 0 {
+		ret = fmt.Sprint(op.ret)
+	}
+	if op.insert {
+		return fmt.Sprintf("[%d, %s] insert %s", op.call, ret, op.value)
+	}
+	if !op.found {
+		return fmt.Sprintf("[%d, %s] query -> not found", op.call, ret)
+	}
+	return fmt.Sprintf("[%d, %s] query -> %s", op.call, ret, op.value)
+}
+
+// kvState is the model of one DBEngine key: the value QueryCurrent returns,
+// which is the value of the most recent insert
+type kvState struct {
+	value string
+	found bool
+}
+
+// step applies op to the model, reporting whether its result is consistent
+// with the state and the state after it
+func (s kvState) step(op linOp) (kvState, bool) {
+	if op.insert {
+		return kvState{value: op.value, found: true}, true
+	}
+	return s, op.found == s.found && (!op.found || op.value == s.value)
+}
+
+// CheckLinearizable checks a recorded history against a key-value model of
+// DBEngine: an insert sets the key's current value and a query returns it.
+// Keys are independent in that model, so each key is checked on its own.
+// Failed operations had no effect and are ignored; inserts with an unknown
+// outcome may have taken effect at any point after they were invoked, or
+// not at all.
+func CheckLinearizable(events []HistoryEvent) LinearizabilityResult {
+	byKey := make(map[string][]linOp)
+	open := make(map[int]int) // process -> position of its invocation
+	invokes := make(map[int]HistoryEvent)
+	for pos, event := range events {
+		if event.Type == EventInvoke {
+			open[event.Process] = pos
+			invokes[pos] = event
+			continue
+		}
+		call, ok := open[event.Process]
+		if !ok {
+			continue
+		}
+		delete(open, event.Process)
+		invoke := invokes[call]
+
+		op := linOp{call: call, ret: pos, insert: invoke.Op == OpInsert}
+		switch {
+		case event.Type == EventFail:
+			continue
+		case event.Type == EventInfo:
+			// A query with no answer tells us nothing
+			if !op.insert {
+				continue
+			}
+			op.ret = -1
+		}
+		if op.insert {
+			op.value = encodeHistoryValue(invoke.Value)
+		} else {
+			op.found = event.Found
+			op.value = encodeHistoryValue(event.Value)
+		}
+		byKey[invoke.Key] = append(byKey[invoke.Key], op)
+	}
+	// Operations still open when the history ends are of unknown outcome
+	for _, call := range open {
+		if invoke := invokes[call]; invoke.Op == OpInsert {
+			byKey[invoke.Key] = append(byKey[invoke.Key], linOp{
+				call: call, ret: -1, insert: true, value: encodeHistoryValue(invoke.Value),
+			})
+		}
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ops := byKey[key]
+		sort.Slice(ops, func(i, j int) bool { return ops[i].call < ops[j].call })
+		if !linearizeKey(ops) {
+			result := LinearizabilityResult{Key: key}
+			for _, op := range ops {
+				result.Ops = append(result.Ops, op.String())
+			}
+			return result
+		}
+	}
+	return LinearizabilityResult{Linearizable: true}
+}
+
+// linearizeKey searches for an order of ops, sorted by call, that respects
+// real time and the model. It explores orders depth first and remembers
+// which sets of linearized operations it has already tried from a state.
+func linearizeKey(ops []linOp) bool {
+	// An insert of unknown outcome whose value no read of this key returned
+	// can always be left out, which keeps the search small
+	observed := make(map[string]bool)
+	for _, op := range ops {
+		if !op.insert && op.found {
+			observed[op.value] = true
+		}
+	}
+	kept := make([]linOp, 0, len(ops))
+	for _, op := range ops {
+		if op.ret >= 0 || observed[op.value] {
+			kept = append(kept, op)
+		}
+	}
+	ops = kept
+
+	done := make([]bool, len(ops))
+	seen := make(map[string]bool)
+
+	var search func(state kvState) bool
+	search = func(state kvState) bool {
+		// Every operation that returned must be in the order; inserts of
+		// unknown outcome may be left out
+		deadline := -1
+		for i, op := range ops {
+			if !done[i] && op.ret >= 0 && (deadline < 0 || op.ret < deadline) {
+				deadline = op.ret
+			}
+		}
+		if deadline < 0 {
+			return true
+		}
+
+		key := historyCacheKey(done, state)
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+
+		// An operation may come next if it was invoked before the earliest
+		// pending return
+		for i, op := range ops {
+			if op.call > deadline {
+				break
+			}
+			if done[i] {
+				continue
+			}
+			next, ok := state.step(op)
+			if !ok {
+				continue
+			}
+			done[i] = true
+			if search(next) {
+				return true
+			}
+			done[i] = false
+		}
+		return false
+	}
+	return search(kvState{})
+}
+
+func historyCacheKey(done []bool, state kvState) string {
+	var b strings.Builder
+	for _, d := range done {
+		if d {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	fmt.Fprintf(&b, "|%t|%s", state.found, state.value)
+	return b.String()
+}
+
+// encodeHistoryValue gives values a canonical form so a value read back
+// from JSON compares equal to the one written
+func encodeHistoryValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
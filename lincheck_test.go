@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	lincheckURLs     = flag.String("lincheck.urls", "", "comma-separated API URLs of a running cluster to test instead of an in-process one")
+	lincheckDuration = flag.Duration("lincheck.duration", 2*time.Second, "how long the linearizability workload runs")
+	lincheckOut      = flag.String("lincheck.out", "", "file to write the recorded history to")
+	lincheckRead     = flag.String("lincheck.consistency", "linearizable", "consistency level of the workload's queries")
+)
+
+// history builds a history from a compact description: each line is
+// "process type op key [value|found value|not-found]"
+func history(lines ...string) []HistoryEvent {
+	var events []HistoryEvent
+	for _, line := range lines {
+		var process int
+		var eventType, op, key, rest string
+		fields := strings.Fields(line)
+		fmt.Sscan(fields[0], &process)
+		eventType, op, key = fields[1], fields[2], fields[3]
+		rest = strings.Join(fields[4:], " ")
+
+		event := HistoryEvent{Type: eventType, Process: process, Op: op, Key: key}
+		switch {
+		case rest == "not-found":
+		case op == OpQuery && rest != "":
+			event.Found, event.Value = true, rest
+		case rest != "":
+			event.Value = rest
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []HistoryEvent
+		want   bool
+	}{
+		{"sequential", history(
+			"1 invoke query a",
+			"1 ok query a not-found",
+			"1 invoke insert a x",
+			"1 ok insert a x",
+			"2 invoke query a",
+			"2 ok query a x",
+		), true},
+		{"concurrent read sees either value", history(
+			"1 invoke insert a x",
+			"2 invoke query a",
+			"2 ok query a not-found",
+			"3 invoke query a",
+			"3 ok query a x",
+			"1 ok insert a x",
+		), true},
+		{"read after a completed write misses it", history(
+			"1 invoke insert a x",
+			"1 ok insert a x",
+			"2 invoke query a",
+			"2 ok query a not-found",
+		), false},
+		{"reads go back in time", history(
+			"1 invoke insert a x",
+			"1 ok insert a x",
+			"1 invoke insert a y",
+			"2 invoke query a",
+			"2 ok query a y",
+			"3 invoke query a",
+			"3 ok query a x",
+			"1 ok insert a y",
+		), false},
+		{"value nobody wrote", history(
+			"1 invoke query a",
+			"1 ok query a z",
+		), false},
+		{"failed insert never takes effect", history(
+			"1 invoke insert a x",
+			"1 fail insert a x",
+			"2 invoke query a",
+			"2 ok query a x",
+		), false},
+		{"insert of unknown outcome may take effect later", history(
+			"1 invoke insert a x",
+			"1 info insert a x",
+			"2 invoke query a",
+			"2 ok query a not-found",
+			"2 invoke query a",
+			"2 ok query a x",
+		), true},
+		{"insert still open when the history ends", history(
+			"1 invoke insert a x",
+			"2 invoke query a",
+			"2 ok query a x",
+		), true},
+		{"keys are independent", history(
+			"1 invoke insert a x",
+			"1 ok insert a x",
+			"2 invoke query b",
+			"2 ok query b not-found",
+		), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := CheckLinearizable(tt.events)
+			if result.Linearizable != tt.want {
+				t.Errorf("CheckLinearizable = %v, want linearizable %v", result, tt.want)
+			}
+		})
+	}
+}
+
+// freePorts reserves n loopback ports and releases them for the caller
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	var ports []int
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("reserve port: %v", err)
+		}
+		listeners = append(listeners, l)
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	return ports
+}
+
+// startLoopbackCluster runs a three-node cluster in this process on the TCP
+// transport, with each node's API on its own loopback port, and returns the
+// API URLs
+func startLoopbackCluster(t *testing.T) []string {
+	t.Helper()
+	ports := freePorts(t, 6)
+	members := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		members[fmt.Sprintf("n%d", i+1)] = fmt.Sprintf("127.0.0.1:%d", ports[i])
+	}
+	cfg := RaftConfig{ElectionTimeoutMS: 300, HeartbeatIntervalMS: 50, SnapshotThreshold: 100}
+
+	var urls []string
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("n%d", i+1)
+		httpAddr := fmt.Sprintf("127.0.0.1:%d", ports[3+i])
+		dir := t.TempDir()
+		db, err := NewDBEngine(dir, DefaultConfig().Database)
+		if err != nil {
+			t.Fatalf("NewDBEngine(%s): %v", id, err)
+		}
+		crdtStore := NewCRDTStore()
+		node, err := NewRaftNode(id, NewTCPTransport(ports[i], cfg.ElectionTimeout()), httpAddr, dir, cfg, members, db, crdtStore)
+		if err != nil {
+			t.Fatalf("NewRaftNode(%s): %v", id, err)
+		}
+		listener, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			t.Fatalf("listen on %s: %v", httpAddr, err)
+		}
+		server := &http.Server{Handler: NewAPIServer(ports[3+i], db, node, crdtStore).Handler()}
+		go server.Serve(listener)
+		t.Cleanup(func() {
+			server.Close()
+			node.Shutdown()
+			db.Close()
+		})
+		urls = append(urls, "http://"+httpAddr)
+	}
+	return urls
+}
+
+// lincheckClient is one workload process. It talks to any node and lets
+// the cluster redirect it to the leader.
+type lincheckClient struct {
+	process  int
+	urls     []string
+	http     *http.Client
+	recorder *HistoryRecorder
+	rand     *rand.Rand
+}
+
+func (c *lincheckClient) insert(key, value string) {
+	c.recorder.Invoke(c.process, OpInsert, key, value)
+	body, _ := json.Marshal(map[string]string{
+		"key":         key,
+		"value":       value,
+		"valid_start": "2000-01-01T00:00:00Z",
+	})
+	resp, err := c.http.Post(c.url()+"/api/v1/insert", "application/json", bytes.NewReader(body))
+	if err != nil {
+		c.recorder.Complete(c.process, EventInfo, nil, false)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		c.recorder.Complete(c.process, EventOk, nil, false)
+	} else {
+		// A write that failed on the leader may still have been committed
+		c.recorder.Complete(c.process, EventInfo, nil, false)
+	}
+}
+
+func (c *lincheckClient) query(key string) {
+	c.recorder.Invoke(c.process, OpQuery, key, nil)
+	resp, err := c.http.Get(c.url() + "/api/v1/query?consistency=" + url.QueryEscape(*lincheckRead) + "&key=" + url.QueryEscape(key))
+	if err != nil {
+		c.recorder.Complete(c.process, EventFail, nil, false)
+		return
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Found bool        `json:"found"`
+		Value interface{} `json:"value"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&result) != nil {
+		c.recorder.Complete(c.process, EventFail, nil, false)
+		return
+	}
+	c.recorder.Complete(c.process, EventOk, result.Value, result.Found)
+}
+
+func (c *lincheckClient) url() string {
+	return c.urls[c.rand.Intn(len(c.urls))]
+}
+
+// TestLinearizableHistory runs a concurrent insert and query workload,
+// records its history and checks it for linearizability. By default it
+// starts a three-node cluster on loopback; -lincheck.urls points it at a
+// cluster started by hand instead.
+func TestLinearizableHistory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("linearizability workload skipped in short mode")
+	}
+	var urls []string
+	if *lincheckURLs != "" {
+		urls = strings.Split(*lincheckURLs, ",")
+	} else {
+		urls = startLoopbackCluster(t)
+	}
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	waitFor(t, 10*time.Second, "a leader", func() bool {
+		for _, u := range urls {
+			resp, err := httpClient.Get(u + "/api/v1/status")
+			if err != nil {
+				continue
+			}
+			var status struct {
+				State string `json:"raft_state"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&status)
+			resp.Body.Close()
+			if err == nil && status.State == "leader" {
+				return true
+			}
+		}
+		return false
+	})
+
+	recorder := NewHistoryRecorder()
+	// Fresh keys keep earlier runs against the same cluster out of the history
+	run := time.Now().UnixNano()
+	keys := []string{fmt.Sprintf("lin:%d:a", run), fmt.Sprintf("lin:%d:b", run), fmt.Sprintf("lin:%d:c", run)}
+	deadline := time.Now().Add(*lincheckDuration)
+
+	var wg sync.WaitGroup
+	for p := 1; p <= 6; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			c := &lincheckClient{process: p, urls: urls, http: httpClient, recorder: recorder, rand: rand.New(rand.NewSource(int64(p)))}
+			for i := 0; time.Now().Before(deadline); i++ {
+				key := keys[c.rand.Intn(len(keys))]
+				if c.rand.Intn(2) == 0 {
+					c.insert(key, fmt.Sprintf("p%d-%d", p, i))
+				} else {
+					c.query(key)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	events := recorder.Events()
+	if *lincheckOut != "" {
+		if err := recorder.WriteFile(*lincheckOut); err != nil {
+			t.Fatalf("write history: %v", err)
+		}
+	}
+	ok := 0
+	for _, event := range events {
+		if event.Type == EventOk {
+			ok++
+		}
+	}
+	if ok == 0 {
+		t.Fatalf("no operation succeeded in %d events", len(events))
+	}
+	t.Logf("%d events, %d successful operations", len(events), ok)
+	if result := CheckLinearizable(events); !result.Linearizable {
+		t.Fatal(result)
+	}
+}
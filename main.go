@@ -10,23 +10,44 @@ import (
 )
 
 var (
-	nodeID   = flag.String("node", "node1", "Node ID for this instance")
-	httpPort = flag.Int("http", 8080, "HTTP API port")
-	raftPort = flag.Int("raft", 9000, "Raft consensus port")
-	join     = flag.String("join", "", "Address of existing node to join")
-	dataDir  = flag.String("data", "./data", "Data directory")
+	nodeID       = flag.String("node", "node1", "Node ID for this instance")
+	httpPort     = flag.Int("http", 8080, "HTTP API port")
+	raftPort     = flag.Int("raft", 9000, "Raft consensus port")
+	join         = flag.String("join", "", "Address of existing node to join")
+	learner      = flag.Bool("learner", false, "Join as a non-voting learner that only receives the log")
+	dataDir      = flag.String("data", "./data", "Data directory")
+	config       = flag.String("config", "", "Path to JSON configuration file")
+	checkHistory = flag.String("check-history", "", "Check a recorded client history for linearizability and exit")
 )
 
 func main() {
 	flag.Parse()
 
+	if *checkHistory != "" {
+		events, err := ReadHistory(*checkHistory)
+		if err != nil {
+			log.Fatalf("Failed to load history: %v", err)
+		}
+		result := CheckLinearizable(events)
+		fmt.Println(result)
+		if !result.Linearizable {
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Printf("Starting Chrono-DB node: %s\n", *nodeID)
 	log.Printf("HTTP API: http://localhost:%d\n", *httpPort)
 	log.Printf("Raft Port: %d\n", *raftPort)
 	log.Printf("Data Directory: %s\n", *dataDir)
 
+	cfg, err := LoadConfig(*config)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
 	// Initialize database engine
-	db, err := NewDBEngine(*dataDir)
+	db, err := NewDBEngine(*dataDir, cfg.Database)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
@@ -36,8 +57,19 @@ func main() {
 	crdtStore := NewCRDTStore()
 	log.Println("CRDT store initialized for multi-master replication")
 
-	// Initialize Raft consensus
-	raftNode, err := NewRaftNode(*nodeID, *raftPort, *dataDir, db, crdtStore)
+	// Initialize Raft consensus. A node joining an existing cluster starts
+	// without a configuration and learns it from the leader; otherwise the
+	// cluster section of the config file, or this node alone, bootstraps it.
+	raftAddr := fmt.Sprintf("localhost:%d", *raftPort)
+	members := map[string]string{}
+	if *join == "" {
+		members = cfg.Cluster.Members(*nodeID)
+		if len(members) == 0 {
+			members[*nodeID] = raftAddr
+		}
+	}
+	transport := NewTCPTransport(*raftPort, cfg.Raft.ElectionTimeout())
+	raftNode, err := NewRaftNode(*nodeID, transport, fmt.Sprintf("localhost:%d", *httpPort), *dataDir, cfg.Raft, members, db, crdtStore)
 	if err != nil {
 		log.Fatalf("Failed to initialize Raft: %v", err)
 	}
@@ -45,8 +77,14 @@ func main() {
 
 	// Join existing cluster if specified
 	if *join != "" {
-		log.Printf("Joining cluster at: %s\n", *join)
-		if err := raftNode.Join(*nodeID, fmt.Sprintf("localhost:%d", *raftPort), *join); err != nil {
+		joinCluster := raftNode.Join
+		if *learner {
+			joinCluster = raftNode.JoinAsLearner
+			log.Printf("Joining cluster at: %s as a learner\n", *join)
+		} else {
+			log.Printf("Joining cluster at: %s\n", *join)
+		}
+		if err := joinCluster(*nodeID, raftAddr, *join); err != nil {
 			log.Printf("Warning: Failed to join cluster: %v", err)
 		}
 	}
@@ -68,4 +106,13 @@ func main() {
 	<-sigChan
 
 	log.Println("\nShutting down Chrono-DB...")
+
+	// Hand leadership over first so the cluster does not wait out an
+	// election timeout to replace this node
+	if state, _ := raftNode.GetState(); state == "leader" {
+		log.Println("Transferring leadership before shutdown...")
+		if err := raftNode.TransferLeadership(""); err != nil {
+			log.Printf("Warning: Leadership transfer failed: %v", err)
+		}
+	}
 }
@@ -1,28 +1,108 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 )
 
+const (
+	// tickInterval is how often the consensus loop checks its timers
+	tickInterval = 10 * time.Millisecond
+	// applyTimeout bounds how long Apply waits for an entry to commit
+	applyTimeout = 10 * time.Second
+	// maxAppendEntries caps the number of entries sent in one AppendEntries
+	// RPC, and the number of writes appended to the log in one batch
+	maxAppendEntries = 512
+	// defaultInflightAppends is how many AppendEntries RPCs may be
+	// outstanding to a follower whose log matches the leader's
+	defaultInflightAppends = 4
+)
+
+var (
+	// ErrNotLeader is returned when a write is submitted to a non-leader
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrLeadershipLost is returned when an entry was overwritten by a new leader
+	ErrLeadershipLost = errors.New("raft: leadership lost before entry committed")
+	// ErrApplyTimeout is returned when an entry does not commit in time
+	ErrApplyTimeout = errors.New("raft: timed out waiting for commit")
+	// ErrShutdown is returned when the node stops while a request is pending
+	ErrShutdown = errors.New("raft: node is shutting down")
+)
+
 // RaftNode represents a Raft consensus node
 type RaftNode struct {
-	mu          sync.RWMutex
-	nodeID      string
-	raftPort    int
-	peers       map[string]string // nodeID -> address
-	state       RaftState
-	currentTerm int64
-	votedFor    string
-	log         []LogEntry
-	commitIndex int64
-	lastApplied int64
-	db          *DBEngine
-	crdtStore   *CRDTStore
-	dataDir     string
-	shutdownCh  chan struct{}
+	mu                  sync.RWMutex
+	nodeID              string
+	transport           Transport
+	peers               map[string]peer // every other member, voter or learner
+	members             Membership      // current configuration, including this node
+	initialMembers      Membership      // configuration used until the log carries one
+	snapshotMembers     *Membership     // configuration as of snapshotIndex, if any
+	configIndex         int64           // index of the latest configuration entry
+	snapshotConfigIndex int64           // index of the configuration in snapshotMembers
+	state               RaftState
+	currentTerm         int64
+	votedFor            string
+	leaderID            string
+	leaderHTTPAddr      string     // API address of the leader, learned from its RPCs
+	lastLeaderContact   time.Time  // when this node last heard from a leader
+	leaderCommit        int64      // highest commit index a leader has reported
+	syncedAt            time.Time  // when the leader last reported a commit index this node has applied
+	httpAddr            string     // API address of this node, advertised while leader
+	log                 []LogEntry // entries after snapshotIndex
+	snapshotIndex       int64      // last index covered by the stored snapshot
+	snapshotTerm        int64
+	snapshotThreshold   int64
+	applyMu             sync.Mutex // held while the state machine is being changed
+	commitIndex         int64
+	lastApplied         int64
+	nextIndex           map[string]int64     // leader only: next entry to send each peer
+	matchIndex          map[string]int64     // leader only: highest entry known replicated
+	peerSince           map[string]int64     // index of the configuration that added each peer
+	replicating         map[string]bool      // leader only: a replicateTo loop is running
+	inflight            map[string]int       // leader only: AppendEntries RPCs awaiting a reply
+	pipelined           map[string]bool      // leader only: the peer's log is known to match
+	maxInflight         int                  // RPCs allowed in flight to a pipelined peer
+	lastAck             map[string]time.Time // leader only: send time of the last RPC each peer acknowledged
+	pending             map[int64]pendingApply
+	proposeMu           sync.Mutex    // guards proposals
+	proposals           []*proposal   // client commands waiting to be appended
+	proposeCh           chan struct{} // wakes runProposals
+	maxBatch            int           // most proposals appended in one batch
+	applyCond           *sync.Cond
+	lastTxTime          time.Time // latest transaction time assigned or applied
+	electionTimeout     time.Duration
+	heartbeatInterval   time.Duration
+	electionDeadline    time.Time
+	lastHeartbeat       time.Time
+	leaderSince         time.Time // when this node last became leader
+	transferTarget      string    // leader only: node leadership is being handed to
+	noLeaseUntil        time.Time // leader only: no lease reads before this time
+	stats               RaftStats
+	rand                *rand.Rand
+	clock               Clock
+	storage             *RaftStorage
+	hardState           HardState // last term and vote written to storage
+	db                  *DBEngine
+	crdtStore           *CRDTStore
+	dataDir             string
+	shutdownCh          chan struct{}
+}
+
+// RaftStats counts election and replication events since the node started
+type RaftStats struct {
+	PreVotes             int64 `json:"pre_votes"`               // pre-vote rounds started
+	PreVotesRejected     int64 `json:"pre_votes_rejected"`      // pre-vote requests refused
+	Elections            int64 `json:"elections"`               // elections started after a successful pre-vote
+	ElectionsWon         int64 `json:"elections_won"`           // elections that made this node leader
+	CheckQuorumStepDowns int64 `json:"check_quorum_step_downs"` // times this node stepped down after losing contact with a majority
+	AppendBatches        int64 `json:"append_batches"`          // batches of client writes appended to the log as leader
+	BatchedEntries       int64 `json:"batched_entries"`         // client writes in those batches
 }
 
 // RaftState represents the state of a Raft node
@@ -34,143 +114,662 @@ const (
 	Leader
 )
 
-// LogEntry represents a log entry in Raft
+// String returns the state's name as reported in the status API
+func (s RaftState) String() string {
+	switch s {
+	case Leader:
+		return "leader"
+	case Candidate:
+		return "candidate"
+	}
+	return "follower"
+}
+
+// EntryType distinguishes state machine commands from configuration changes
+type EntryType int
+
+const (
+	// EntryCommand carries an encoded Command, or nothing for a leader no-op
+	EntryCommand EntryType = iota
+	// EntryConfig carries an encoded Membership
+	EntryConfig
+)
+
+// LogEntry represents a log entry in Raft. Command holds an encoded Command
+// or Membership depending on Type; it is empty for the no-op a new leader
+// appends at the start of its term.
 type LogEntry struct {
-	Term    int64       `json:"term"`
-	Index   int64       `json:"index"`
-	Command interface{} `json:"command"`
+	Term    int64           `json:"term"`
+	Index   int64           `json:"index"`
+	Type    EntryType       `json:"type,omitempty"`
+	Command json.RawMessage `json:"command,omitempty"`
 }
 
-// NewRaftNode creates a new Raft node
-func NewRaftNode(nodeID string, raftPort int, dataDir string, db *DBEngine, crdtStore *CRDTStore) (*RaftNode, error) {
+// pendingApply tracks a client waiting for its entry to be applied
+type pendingApply struct {
+	term int64
+	done chan error
+}
+
+// NewRaftNode creates a new Raft node. httpAddr is the API address clients
+// are redirected to while this node leads. members is the configuration to
+// start from when the log does not carry one yet: this node plus any
+// statically configured peers, or empty for a node that will join an
+// existing cluster.
+func NewRaftNode(nodeID string, transport Transport, httpAddr string, dataDir string, cfg RaftConfig, members map[string]string, db *DBEngine, crdtStore *CRDTStore) (*RaftNode, error) {
+	return newRaftNode(nodeID, transport, httpAddr, dataDir, cfg, members, db, crdtStore, realClock{}, time.Now().UnixNano())
+}
+
+// newRaftNode creates a Raft node that takes its time from clock and seeds
+// its election jitter with seed, so simulations can replay it exactly
+func newRaftNode(nodeID string, transport Transport, httpAddr string, dataDir string, cfg RaftConfig, members map[string]string, db *DBEngine, crdtStore *CRDTStore, clock Clock, seed int64) (*RaftNode, error) {
+	storage, err := OpenRaftStorage(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	hardState, err := storage.LoadHardState()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	base, entries, err := storage.LoadLog()
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to recover raft log: %w", err)
+	}
+	snap, err := loadRaftSnapshot(storage)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	if snap == nil && base > 0 {
+		storage.Close()
+		return nil, fmt.Errorf("raft log was compacted up to index %d but no snapshot was found", base)
+	}
+
 	node := &RaftNode{
-		nodeID:      nodeID,
-		raftPort:    raftPort,
-		peers:       make(map[string]string),
-		state:       Follower,
-		currentTerm: 0,
-		log:         []LogEntry{},
-		commitIndex: 0,
-		lastApplied: 0,
-		db:          db,
-		crdtStore:   crdtStore,
-		dataDir:     dataDir,
-		shutdownCh:  make(chan struct{}),
+		nodeID:            nodeID,
+		transport:         transport,
+		httpAddr:          httpAddr,
+		peers:             make(map[string]peer),
+		members:           newMembership(),
+		initialMembers:    newMembership(),
+		state:             Follower,
+		currentTerm:       hardState.CurrentTerm,
+		votedFor:          hardState.VotedFor,
+		log:               entries,
+		snapshotIndex:     base,
+		snapshotThreshold: cfg.SnapshotThreshold,
+		commitIndex:       0,
+		lastApplied:       0,
+		nextIndex:         make(map[string]int64),
+		matchIndex:        make(map[string]int64),
+		peerSince:         make(map[string]int64),
+		replicating:       make(map[string]bool),
+		inflight:          make(map[string]int),
+		pipelined:         make(map[string]bool),
+		maxInflight:       cfg.InflightAppends(),
+		lastAck:           make(map[string]time.Time),
+		pending:           make(map[int64]pendingApply),
+		proposeCh:         make(chan struct{}, 1),
+		maxBatch:          cfg.BatchSize(),
+		electionTimeout:   cfg.ElectionTimeout(),
+		heartbeatInterval: cfg.HeartbeatInterval(),
+		rand:              rand.New(rand.NewSource(seed)),
+		clock:             clock,
+		storage:           storage,
+		hardState:         hardState,
+		db:                db,
+		crdtStore:         crdtStore,
+		dataDir:           dataDir,
+		shutdownCh:        make(chan struct{}),
+	}
+	for id, addr := range members {
+		node.initialMembers.Voters[id] = addr
+	}
+	node.applyCond = sync.NewCond(&node.mu)
+	node.resetElectionTimer()
+
+	if snap != nil {
+		if err := node.recoverSnapshot(snap); err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+	node.setMembership(node.latestMembership())
+
+	if err := transport.Serve(node); err != nil {
+		storage.Close()
+		return nil, err
 	}
 
 	// Start background consensus process
 	go node.runConsensus()
+	go node.runApplier()
+	go node.runProposals()
 
-	log.Printf("Raft node initialized: %s (port: %d)\n", nodeID, raftPort)
+	log.Printf("Raft node initialized: %s (peers: %d, term: %d, log entries: %d)\n",
+		nodeID, len(node.peers), node.currentTerm, len(node.log))
 	return node, nil
 }
 
-// Join adds this node to an existing cluster
-func (r *RaftNode) Join(nodeID, addr, leaderAddr string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	// In a real implementation, this would send a join request to the leader
-	// For now, we'll just add the peer
-	r.peers[nodeID] = addr
-	log.Printf("Node %s joined cluster. Peers: %v\n", nodeID, r.peers)
-	return nil
-}
-
 // runConsensus runs the Raft consensus algorithm
 func (r *RaftNode) runConsensus() {
-	ticker := time.NewTicker(500 * time.Millisecond)
+	ticker := r.clock.NewTicker(tickInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-r.shutdownCh:
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			r.mu.RLock()
 			state := r.state
+			now := r.clock.Now()
+			electionDue := now.After(r.electionDeadline)
+			heartbeatDue := now.Sub(r.lastHeartbeat) >= r.heartbeatInterval
 			r.mu.RUnlock()
 
 			switch state {
-			case Follower:
-				// Follower logic - wait for heartbeats
-			case Candidate:
-				// Start election
-				r.startElection()
+			case Follower, Candidate:
+				// No word from a leader within the election timeout
+				if electionDue && r.isVoter() {
+					r.campaign()
+				}
 			case Leader:
-				// Send heartbeats
-				r.sendHeartbeats()
+				if heartbeatDue {
+					r.sendHeartbeats()
+				}
+				r.checkQuorum()
+			}
+		}
+	}
+}
+
+// resetElectionTimer picks a new randomized election deadline in [T, 2T).
+// Callers must hold r.mu.
+func (r *RaftNode) resetElectionTimer() {
+	jitter := time.Duration(r.rand.Int63n(int64(r.electionTimeout)))
+	r.electionDeadline = r.clock.Now().Add(r.electionTimeout + jitter)
+}
+
+// lastLogIndexTerm returns the index and term of the last log entry.
+// Callers must hold r.mu.
+func (r *RaftNode) lastLogIndexTerm() (int64, int64) {
+	if len(r.log) == 0 {
+		return r.snapshotIndex, r.snapshotTerm
+	}
+	last := r.log[len(r.log)-1]
+	return last.Index, last.Term
+}
+
+// termAt returns the term of the entry at index, or 0 if it is not in the
+// log. Callers must hold r.mu.
+func (r *RaftNode) termAt(index int64) int64 {
+	if index == r.snapshotIndex {
+		return r.snapshotTerm
+	}
+	pos := index - r.snapshotIndex - 1
+	if pos < 0 || pos >= int64(len(r.log)) {
+		return 0
+	}
+	return r.log[pos].Term
+}
+
+// entryAt returns the entry at index if it has not been compacted away.
+// Callers must hold r.mu.
+func (r *RaftNode) entryAt(index int64) (LogEntry, bool) {
+	pos := index - r.snapshotIndex - 1
+	if pos < 0 || pos >= int64(len(r.log)) {
+		return LogEntry{}, false
+	}
+	return r.log[pos], true
+}
+
+// entriesFrom returns up to max entries starting at index.
+// Callers must hold r.mu.
+func (r *RaftNode) entriesFrom(index int64, max int) []LogEntry {
+	pos := index - r.snapshotIndex - 1
+	if pos < 0 || pos >= int64(len(r.log)) {
+		return nil
+	}
+	entries := r.log[pos:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]LogEntry(nil), entries...)
+}
+
+// appendLocal durably appends a new entry for the current term to the
+// leader's log. Callers must hold r.mu.
+func (r *RaftNode) appendLocal(entryType EntryType, data json.RawMessage) (LogEntry, error) {
+	lastIndex, _ := r.lastLogIndexTerm()
+	entry := LogEntry{
+		Term:    r.currentTerm,
+		Index:   lastIndex + 1,
+		Type:    entryType,
+		Command: data,
+	}
+	return entry, r.appendLeaderEntries([]LogEntry{entry})
+}
+
+// appendLeaderEntries durably appends entries for the current term to the
+// leader's log with a single write and fsync. Configuration entries take
+// effect as soon as they are appended. Callers must hold r.mu.
+func (r *RaftNode) appendLeaderEntries(entries []LogEntry) error {
+	if err := r.storage.AppendEntries(entries); err != nil {
+		return err
+	}
+	r.log = append(r.log, entries...)
+	for _, entry := range entries {
+		if entry.Type == EntryConfig {
+			r.setMembership(r.latestMembership())
+			break
+		}
+	}
+	// A single voter commits its own entries
+	r.advanceCommitIndex()
+	return nil
+}
+
+// persistHardState writes the current term and vote if they changed since
+// the last write. Callers must hold r.mu.
+func (r *RaftNode) persistHardState() error {
+	hs := HardState{CurrentTerm: r.currentTerm, VotedFor: r.votedFor}
+	if hs == r.hardState {
+		return nil
+	}
+	if err := r.storage.SaveHardState(hs); err != nil {
+		log.Printf("Raft: failed to persist term and vote: %v\n", err)
+		return err
+	}
+	r.hardState = hs
+	return nil
+}
+
+// quorum returns the number of votes needed for a majority.
+// Callers must hold r.mu.
+func (r *RaftNode) quorum() int {
+	return len(r.members.Voters)/2 + 1
+}
+
+// becomeFollower steps down to follower, adopting term if it is newer. If
+// the new term cannot be saved the node stays in the last term and vote on
+// disk and the error is returned; callers must not act on the new term then.
+// Callers must hold r.mu.
+func (r *RaftNode) becomeFollower(term int64) error {
+	if r.state != Follower {
+		log.Printf("Node %s stepping down to follower in term %d\n", r.nodeID, term)
+	}
+	r.state = Follower
+	if r.leaderID == r.nodeID {
+		r.leaderID = ""
+		r.leaderHTTPAddr = ""
+	}
+	// Wake reads waiting on this node's leadership
+	r.applyCond.Broadcast()
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		r.leaderID = ""
+		r.leaderHTTPAddr = ""
+		if err := r.persistHardState(); err != nil {
+			r.currentTerm = r.hardState.CurrentTerm
+			r.votedFor = r.hardState.VotedFor
+			return err
+		}
+	}
+	return nil
+}
+
+// becomeLeader takes over leadership for the current term.
+// Callers must hold r.mu.
+func (r *RaftNode) becomeLeader() {
+	r.state = Leader
+	r.leaderID = r.nodeID
+	r.leaderHTTPAddr = r.httpAddr
+	r.lastHeartbeat = time.Time{}
+	r.leaderSince = r.clock.Now()
+	r.stats.ElectionsWon++
+
+	lastIndex, _ := r.lastLogIndexTerm()
+	for id := range r.peers {
+		r.nextIndex[id] = lastIndex + 1
+		r.matchIndex[id] = 0
+	}
+	r.lastAck = make(map[string]time.Time)
+	r.inflight = make(map[string]int)
+	r.pipelined = make(map[string]bool)
+	r.catchUpTxTime()
+	log.Printf("Node %s became leader for term %d\n", r.nodeID, r.currentTerm)
+
+	// A no-op entry lets the new leader commit entries from earlier terms.
+	// A cluster that has never recorded its configuration in the log (a
+	// bootstrapped or statically configured one) writes it now instead.
+	entryType, data := EntryCommand, json.RawMessage(nil)
+	if r.configIndex == 0 {
+		encoded, err := encodeMembership(r.members)
+		if err != nil {
+			log.Printf("Raft: failed to encode configuration: %v\n", err)
+		} else {
+			entryType, data = EntryConfig, encoded
+		}
+	}
+	if _, err := r.appendLocal(entryType, data); err != nil {
+		log.Printf("Raft: failed to append no-op entry: %v\n", err)
+	}
+}
+
+// campaign runs a pre-vote round and only starts a real election once a
+// majority of voters has said it would grant its vote. A node cut off from
+// the cluster keeps failing the pre-vote instead of raising its term, so it
+// cannot depose a healthy leader when it comes back.
+func (r *RaftNode) campaign() {
+	r.mu.Lock()
+	r.resetElectionTimer()
+	if r.quorum() <= 1 {
+		r.mu.Unlock()
+		r.startElection(false)
+		return
+	}
+	r.stats.PreVotes++
+	lastIndex, lastTerm := r.lastLogIndexTerm()
+	args := RequestVoteArgs{
+		Term:         r.currentTerm + 1,
+		CandidateID:  r.nodeID,
+		LastLogIndex: lastIndex,
+		LastLogTerm:  lastTerm,
+		PreVote:      true,
+	}
+	peers := r.otherVoters()
+	r.mu.Unlock()
+
+	granted := 1
+	elected := false
+	for _, addr := range peers {
+		go func(addr string) {
+			var reply RequestVoteReply
+			if err := r.transport.RequestVote(addr, &args, &reply); err != nil {
+				return
 			}
+
+			r.mu.Lock()
+			if reply.Term > r.currentTerm {
+				r.becomeFollower(reply.Term)
+				r.resetElectionTimer()
+				r.mu.Unlock()
+				return
+			}
+			if reply.VoteGranted {
+				granted++
+			}
+			// Skip the election if a leader made contact in the meantime
+			start := !elected && granted >= r.quorum() && r.currentTerm == args.Term-1 &&
+				r.state != Leader && !r.leaderAlive()
+			if start {
+				elected = true
+			}
+			r.mu.Unlock()
+
+			if start {
+				r.startElection(false)
+			}
+		}(addr)
+	}
+}
+
+// otherVoters returns the voters other than this node.
+// Callers must hold r.mu.
+func (r *RaftNode) otherVoters() map[string]string {
+	voters := make(map[string]string, len(r.peers))
+	for id, p := range r.peers {
+		if p.role == RoleVoter {
+			voters[id] = p.addr
 		}
 	}
+	return voters
 }
 
-// startElection initiates a new election
-func (r *RaftNode) startElection() {
+// checkQuorum steps a leader down once a majority of voters has not
+// acknowledged any of its RPCs for an election timeout. A leader on the
+// minority side of a partition then stops accepting writes it can never
+// commit, and lets its followers grant pre-votes to a new candidate.
+func (r *RaftNode) checkQuorum() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	now := r.clock.Now()
+	if r.state != Leader || now.Sub(r.leaderSince) < r.electionTimeout {
+		return
+	}
+	active := 0
+	for id := range r.members.Voters {
+		if id == r.nodeID || now.Sub(r.lastAck[id]) < r.electionTimeout {
+			active++
+		}
+	}
+	if active < r.quorum() {
+		log.Printf("Node %s lost contact with a majority, stepping down in term %d\n", r.nodeID, r.currentTerm)
+		r.stats.CheckQuorumStepDowns++
+		r.becomeFollower(r.currentTerm)
+		r.resetElectionTimer()
+	}
+}
+
+// startElection initiates a new election. transfer marks an election the
+// leader asked for to hand over leadership.
+func (r *RaftNode) startElection(transfer bool) {
+	r.mu.Lock()
+	r.stats.Elections++
+	r.state = Candidate
 	r.currentTerm++
 	r.votedFor = r.nodeID
+	r.leaderID = ""
+	r.leaderHTTPAddr = ""
+	r.resetElectionTimer()
 	log.Printf("Node %s starting election for term %d\n", r.nodeID, r.currentTerm)
 
+	// The vote for ourselves must be on disk before asking for others
+	if err := r.persistHardState(); err != nil {
+		r.state = Follower
+		r.currentTerm = r.hardState.CurrentTerm
+		r.votedFor = r.hardState.VotedFor
+		r.mu.Unlock()
+		return
+	}
+
 	// In a single-node setup, become leader immediately
-	if len(r.peers) == 0 {
-		r.state = Leader
-		log.Printf("Node %s became leader for term %d\n", r.nodeID, r.currentTerm)
+	votes := 1
+	if votes >= r.quorum() {
+		r.becomeLeader()
+		r.mu.Unlock()
+		return
 	}
-}
 
-// sendHeartbeats sends heartbeat messages to all peers
-func (r *RaftNode) sendHeartbeats() {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	lastIndex, lastTerm := r.lastLogIndexTerm()
+	args := RequestVoteArgs{
+		Term:               r.currentTerm,
+		CandidateID:        r.nodeID,
+		LastLogIndex:       lastIndex,
+		LastLogTerm:        lastTerm,
+		LeadershipTransfer: transfer,
+	}
+	// Learners replicate the log but take no part in elections
+	peers := r.otherVoters()
+	r.mu.Unlock()
 
-	if len(r.peers) > 0 {
-		log.Printf("Leader %s sending heartbeats to %d peers\n", r.nodeID, len(r.peers))
+	for _, addr := range peers {
+		go func(addr string) {
+			var reply RequestVoteReply
+			if err := r.transport.RequestVote(addr, &args, &reply); err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if reply.Term > r.currentTerm {
+				r.becomeFollower(reply.Term)
+				r.resetElectionTimer()
+				return
+			}
+			if r.state != Candidate || r.currentTerm != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= r.quorum() {
+				r.becomeLeader()
+			}
+		}(addr)
 	}
 }
 
-// Apply applies a command to the state machine
-func (r *RaftNode) Apply(command interface{}) error {
+// handleRequestVote decides whether to grant a vote to a candidate
+func (r *RaftNode) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// In a real implementation, this would replicate the command via Raft
-	// For now, apply it directly
-	entry := LogEntry{
-		Term:    r.currentTerm,
-		Index:   int64(len(r.log) + 1),
-		Command: command,
+	// A pre-vote asks whether this node would vote for the candidate in the
+	// next term; answering changes neither its term nor its vote
+	if args.PreVote {
+		reply.Term = r.currentTerm
+		reply.VoteGranted = args.Term > r.currentTerm && !r.leaderAlive() && r.candidateUpToDate(args)
+		if !reply.VoteGranted {
+			r.stats.PreVotesRejected++
+		}
+		return
 	}
 
-	r.log = append(r.log, entry)
-	r.commitIndex = entry.Index
-	r.lastApplied = entry.Index
+	// Ignore candidates while a leader is known to be alive. This keeps
+	// removed servers from disrupting the cluster, and is what makes leader
+	// leases safe: no new leader can be elected within an election timeout of
+	// a majority last hearing from the current one. The exception is an
+	// election the leader itself asked for to hand over leadership.
+	if args.Term > r.currentTerm && r.leaderAlive() && !args.LeadershipTransfer {
+		reply.Term = r.currentTerm
+		return
+	}
 
-	log.Printf("Raft applied command at index %d\n", entry.Index)
+	if args.Term > r.currentTerm {
+		if err := r.becomeFollower(args.Term); err != nil {
+			reply.Term = r.currentTerm
+			return
+		}
+	}
+	reply.Term = r.currentTerm
+	if args.Term < r.currentTerm {
+		return
+	}
+
+	if (r.votedFor == "" || r.votedFor == args.CandidateID) && r.candidateUpToDate(args) {
+		r.votedFor = args.CandidateID
+		if err := r.persistHardState(); err != nil {
+			r.votedFor = r.hardState.VotedFor
+			return
+		}
+		reply.VoteGranted = true
+		r.resetElectionTimer()
+		log.Printf("Node %s voted for %s in term %d\n", r.nodeID, args.CandidateID, args.Term)
+	}
+}
+
+// candidateUpToDate reports whether the candidate's log is at least as up to
+// date as ours, which it must be to get our vote.
+// Callers must hold r.mu.
+func (r *RaftNode) candidateUpToDate(args *RequestVoteArgs) bool {
+	lastIndex, lastTerm := r.lastLogIndexTerm()
+	return args.LastLogTerm > lastTerm ||
+		(args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+}
+
+// Apply replicates a command through the log and waits until a majority of
+// the cluster has stored it and it has been applied locally. The error
+// returned is the result of applying the command to the state machine.
+// Commands from concurrent callers are appended to the log in batches.
+func (r *RaftNode) Apply(cmd Command) error {
+	p := &proposal{cmd: &cmd, done: make(chan error, 1)}
+	r.enqueueProposal(p)
+	return r.awaitApplied(p)
+}
+
+// canPropose reports why this node cannot append new entries, if it cannot.
+// Callers must hold r.mu.
+func (r *RaftNode) canPropose() error {
+	if r.state != Leader {
+		return ErrNotLeader
+	}
+	// The log must stop growing for the transfer target to catch up
+	if r.transferTarget != "" {
+		return ErrTransferInProgress
+	}
 	return nil
 }
 
-// GetState returns the current state of the Raft node
-func (r *RaftNode) GetState() (string, int64) {
+// appendProposal appends a single entry as leader and registers for the
+// result of applying it. Callers must hold r.mu.
+func (r *RaftNode) appendProposal(entryType EntryType, data json.RawMessage) (*proposal, error) {
+	if err := r.canPropose(); err != nil {
+		return nil, err
+	}
+	entry, err := r.appendLocal(entryType, data)
+	if err != nil {
+		return nil, err
+	}
+	p := &proposal{index: entry.Index, done: make(chan error, 1)}
+	r.pending[entry.Index] = pendingApply{term: entry.Term, done: p.done}
+	return p, nil
+}
+
+// awaitApplied waits for the result of a proposal
+func (r *RaftNode) awaitApplied(p *proposal) error {
+	select {
+	case err := <-p.done:
+		return err
+	case <-r.clock.After(applyTimeout):
+		r.mu.Lock()
+		if p.index > 0 {
+			delete(r.pending, p.index)
+		}
+		r.mu.Unlock()
+		return ErrApplyTimeout
+	case <-r.shutdownCh:
+		return ErrShutdown
+	}
+}
+
+// Leader returns the ID and API address of the leader this node knows
+// about; both are empty while no leader is known
+func (r *RaftNode) Leader() (string, string) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	return r.leaderID, r.leaderHTTPAddr
+}
 
-	stateStr := "follower"
-	switch r.state {
-	case Leader:
-		stateStr = "leader"
-	case Candidate:
-		stateStr = "candidate"
-	}
+// Stats returns the node's election and replication counters
+func (r *RaftNode) Stats() RaftStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.stats
+}
 
-	return stateStr, r.currentTerm
+// GetState returns the current state of the Raft node
+func (r *RaftNode) GetState() (string, int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state.String(), r.currentTerm
 }
 
 // Shutdown stops the Raft node
 func (r *RaftNode) Shutdown() error {
 	log.Printf("Shutting down Raft node %s\n", r.nodeID)
 	close(r.shutdownCh)
-	return nil
+	err := r.transport.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applyCond.Broadcast()
+	if cerr := r.storage.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// proposal is a write waiting to be appended to the leader's log and
+// applied. done receives the result exactly once: the error that kept it out
+// of the log, or the result of applying it.
+type proposal struct {
+	cmd   *Command // client command, encoded when its batch is appended
+	index int64    // log index once appended; guarded by r.mu
+	done  chan error
+}
+
+// enqueueProposal queues a client command for the next batch
+func (r *RaftNode) enqueueProposal(p *proposal) {
+	r.proposeMu.Lock()
+	r.proposals = append(r.proposals, p)
+	r.proposeMu.Unlock()
+
+	select {
+	case r.proposeCh <- struct{}{}:
+	default:
+	}
+}
+
+// takeProposals removes up to max queued proposals, oldest first
+func (r *RaftNode) takeProposals(max int) []*proposal {
+	r.proposeMu.Lock()
+	defer r.proposeMu.Unlock()
+
+	n := len(r.proposals)
+	if n > max {
+		n = max
+	}
+	batch := r.proposals[:n:n]
+	r.proposals = r.proposals[n:]
+	return batch
+}
+
+// runProposals appends queued client commands to the log in batches. While
+// one batch is written and fsynced the commands that arrive meanwhile queue
+// up, so under load many writes share one WAL record and one fsync (group
+// commit) without any of them waiting for a timer.
+func (r *RaftNode) runProposals() {
+	for {
+		select {
+		case <-r.shutdownCh:
+			return
+		case <-r.proposeCh:
+		}
+		for {
+			batch := r.takeProposals(r.maxBatch)
+			if len(batch) == 0 {
+				break
+			}
+			r.appendBatch(batch)
+		}
+	}
+}
+
+// appendBatch appends a batch of proposals to the leader's log with a single
+// write and starts replicating them
+func (r *RaftNode) appendBatch(batch []*proposal) {
+	r.mu.Lock()
+	if err := r.canPropose(); err != nil {
+		r.mu.Unlock()
+		for _, p := range batch {
+			p.done <- err
+		}
+		return
+	}
+
+	lastIndex, _ := r.lastLogIndexTerm()
+	entries := make([]LogEntry, 0, len(batch))
+	appended := make([]*proposal, 0, len(batch))
+	for _, p := range batch {
+		// Transaction times are assigned here, strictly increasing, so
+		// every replica records the same history in the same order
+		cmd := *p.cmd
+		if cmd.TxTime.IsZero() {
+			cmd.TxTime = r.clock.Now().UTC()
+		}
+		if !cmd.TxTime.After(r.lastTxTime) {
+			cmd.TxTime = r.lastTxTime.Add(time.Nanosecond)
+		}
+		data, err := encodeCommand(cmd)
+		if err != nil {
+			p.done <- err
+			continue
+		}
+		r.lastTxTime = cmd.TxTime
+
+		entries = append(entries, LogEntry{
+			Term:    r.currentTerm,
+			Index:   lastIndex + int64(len(entries)) + 1,
+			Type:    EntryCommand,
+			Command: data,
+		})
+		appended = append(appended, p)
+	}
+	if len(entries) == 0 {
+		r.mu.Unlock()
+		return
+	}
+
+	if err := r.appendLeaderEntries(entries); err != nil {
+		r.mu.Unlock()
+		log.Printf("Raft: failed to append batch of %d entries: %v\n", len(entries), err)
+		for _, p := range appended {
+			p.done <- err
+		}
+		return
+	}
+	for i, p := range appended {
+		p.index = entries[i].Index
+		r.pending[p.index] = pendingApply{term: entries[i].Term, done: p.done}
+	}
+	r.stats.AppendBatches++
+	r.stats.BatchedEntries += int64(len(entries))
+	r.mu.Unlock()
+
+	r.sendHeartbeats()
+}
+
+// catchUpTxTime raises lastTxTime to the latest transaction time this node
+// knows of before it assigns any as leader: those of the records it holds and
+// those of the entries in its log it has not applied yet, which an earlier
+// leader may have stamped with a clock running ahead of ours. Callers must
+// hold r.mu.
+func (r *RaftNode) catchUpTxTime() {
+	if txTime := r.db.LastTxTime(); txTime.After(r.lastTxTime) {
+		r.lastTxTime = txTime
+	}
+	for _, entry := range r.log {
+		if entry.Index <= r.lastApplied || entry.Type != EntryCommand || len(entry.Command) == 0 {
+			continue
+		}
+		cmd, err := decodeCommand(entry.Command)
+		if err != nil {
+			continue
+		}
+		if cmd.TxTime.After(r.lastTxTime) {
+			r.lastTxTime = cmd.TxTime
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// benchConfig keeps leadership stable while the leader's disk is busy
+var benchConfig = RaftConfig{ElectionTimeoutMS: 1000, HeartbeatIntervalMS: 100, SnapshotThreshold: 1 << 30}
+
+func insertCommand(key string, value interface{}) Command {
+	return Command{
+		Type:       CmdInsert,
+		Key:        key,
+		Value:      value,
+		ValidStart: time.Now().Add(-time.Hour),
+		ValidEnd:   time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+}
+
+func TestApplyBatchesConcurrentWrites(t *testing.T) {
+	c := newTestClusterWithConfig(t, 3, benchConfig)
+	leader := c.leader(0)
+	// Let the no-op of the new term commit so every write below is a client
+	// write
+	c.write("warmup", "done")
+	before := leader.Stats()
+
+	// Hold up the leader while the writes queue, as a slow fsync would
+	const writes = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, writes)
+	leader.mu.Lock()
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- leader.Apply(insertCommand(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+		}(i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	leader.mu.Unlock()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+	}
+	for i := 0; i < writes; i++ {
+		c.converged(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), "n1", "n2", "n3")
+	}
+
+	stats := leader.Stats()
+	entries := stats.BatchedEntries - before.BatchedEntries
+	batches := stats.AppendBatches - before.AppendBatches
+	if entries != writes {
+		t.Fatalf("leader batched %d entries, want %d", entries, writes)
+	}
+	// The batcher may have taken the first writes before it blocked; the
+	// rest share a batch
+	if batches > 5 {
+		t.Errorf("%d queued writes took %d batches, want at most 5", writes, batches)
+	}
+}
+
+func TestApplyAssignsIncreasingTxTimesWithinBatch(t *testing.T) {
+	c := newTestCluster(t, 1)
+	leader := c.leader(0)
+
+	// Commands that all ask for the same transaction time still get
+	// distinct, increasing ones. They share a valid-time period, so each
+	// supersedes the last one whole.
+	txTime := time.Now().UTC()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := insertCommand("same", i)
+			cmd.ValidStart = txTime.Add(-time.Hour)
+			cmd.TxTime = txTime
+			if err := leader.Apply(cmd); err != nil {
+				t.Errorf("Apply: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	history := c.dbs["n1"].GetHistory("same")
+	if len(history) != 20 {
+		t.Fatalf("history has %d versions, want 20", len(history))
+	}
+	for i := 1; i < len(history); i++ {
+		if !history[i].TransactionTime.After(history[i-1].TransactionTime) {
+			t.Fatalf("version %d has tx time %v, not after %v", i, history[i].TransactionTime, history[i-1].TransactionTime)
+		}
+	}
+}
+
+// benchmarkApply runs b.N writes from clients concurrent callers against
+// the leader of a three-node cluster
+func benchmarkApply(b *testing.B, cfg RaftConfig, clients int, delay time.Duration) {
+	c := newTestClusterWithConfig(b, 3, cfg)
+	c.network.SetDelay(delay, delay)
+	leader := c.leader(0)
+	c.write("warmup", "done")
+	before := leader.Stats()
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for client := 0; client < clients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := client; i < b.N; i += clients {
+				if err := leader.Apply(insertCommand(fmt.Sprintf("key%d", i), i)); err != nil {
+					b.Errorf("Apply: %v", err)
+					return
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	stats := leader.Stats()
+	if batches := stats.AppendBatches - before.AppendBatches; batches > 0 {
+		b.ReportMetric(float64(stats.BatchedEntries-before.BatchedEntries)/float64(batches), "writes/fsync")
+	}
+}
+
+// BenchmarkApply compares write throughput with group commit and pipelined
+// replication against appending, fsyncing and replicating every write on
+// its own (max_batch_size and max_inflight_appends of 1)
+func BenchmarkApply(b *testing.B) {
+	perRequest := benchConfig
+	perRequest.MaxBatchSize = 1
+	perRequest.MaxInflightAppends = 1
+
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		for _, clients := range []int{1, 16, 64} {
+			b.Run(fmt.Sprintf("per-request/delay=%s/clients=%d", delay, clients), func(b *testing.B) {
+				benchmarkApply(b, perRequest, clients, delay)
+			})
+			b.Run(fmt.Sprintf("batched/delay=%s/clients=%d", delay, clients), func(b *testing.B) {
+				benchmarkApply(b, benchConfig, clients, delay)
+			})
+		}
+	}
+}
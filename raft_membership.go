@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	joinTimeout       = 2 * time.Minute
+	joinRetryInterval = time.Second
+	// promoteMaxLag is how far a learner may trail the leader's commit index
+	// and still be promoted to voter
+	promoteMaxLag = maxAppendEntries
+)
+
+var (
+	// ErrConfigChangePending is returned when a membership change is proposed
+	// before the previous one has committed, or before a new leader has
+	// committed an entry of its own term
+	ErrConfigChangePending = errors.New("raft: a configuration change is pending")
+	// ErrInvalidConfigChange is returned for membership changes that do not
+	// make sense for the current configuration
+	ErrInvalidConfigChange = errors.New("raft: invalid configuration change")
+)
+
+// PeerRole is whether a member votes or only receives the log
+type PeerRole string
+
+const (
+	// RoleVoter members elect leaders and count towards commitment
+	RoleVoter PeerRole = "voter"
+	// RoleLearner members receive the log but never vote, so they can serve
+	// stale and bounded-staleness reads without slowing down writes
+	RoleLearner PeerRole = "learner"
+)
+
+// peer is another member of the configuration that the leader replicates to
+type peer struct {
+	addr string
+	role PeerRole
+}
+
+// Membership is a cluster configuration: the voters that elect leaders and
+// commit entries, and the learners that only receive the log. Both map node
+// IDs to Raft addresses. It is the payload of an EntryConfig log entry.
+type Membership struct {
+	Voters   map[string]string `json:"members"`
+	Learners map[string]string `json:"learners,omitempty"`
+}
+
+// newMembership returns an empty configuration
+func newMembership() Membership {
+	return Membership{
+		Voters:   make(map[string]string),
+		Learners: make(map[string]string),
+	}
+}
+
+// clone returns a deep copy of the configuration
+func (m Membership) clone() Membership {
+	c := newMembership()
+	for id, addr := range m.Voters {
+		c.Voters[id] = addr
+	}
+	for id, addr := range m.Learners {
+		c.Learners[id] = addr
+	}
+	return c
+}
+
+// IsVoter reports whether id is a voting member
+func (m Membership) IsVoter(id string) bool {
+	_, ok := m.Voters[id]
+	return ok
+}
+
+// IsLearner reports whether id is a non-voting member
+func (m Membership) IsLearner(id string) bool {
+	_, ok := m.Learners[id]
+	return ok
+}
+
+// Role returns whether id is a voter or a learner, or "" if it is not a
+// member
+func (m Membership) Role(id string) PeerRole {
+	switch {
+	case m.IsVoter(id):
+		return RoleVoter
+	case m.IsLearner(id):
+		return RoleLearner
+	}
+	return ""
+}
+
+// Addr returns the Raft address of a voter or learner
+func (m Membership) Addr(id string) (string, bool) {
+	if addr, ok := m.Voters[id]; ok {
+		return addr, true
+	}
+	addr, ok := m.Learners[id]
+	return addr, ok
+}
+
+// encodeMembership serializes a configuration for LogEntry.Command
+func encodeMembership(m Membership) (json.RawMessage, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	return data, nil
+}
+
+// decodeMembership parses the Command of an EntryConfig log entry
+func decodeMembership(data json.RawMessage) (Membership, error) {
+	var m Membership
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("failed to decode configuration: %w", err)
+	}
+	return m.clone(), nil
+}
+
+// latestMembership returns the newest configuration in the log, whether or
+// not it is committed, along with the index of the entry that carries it.
+// Callers must hold r.mu.
+func (r *RaftNode) latestMembership() (Membership, int64) {
+	lastIndex, _ := r.lastLogIndexTerm()
+	return r.membershipAt(lastIndex)
+}
+
+// membershipAt returns the configuration in effect at index.
+// Callers must hold r.mu.
+func (r *RaftNode) membershipAt(index int64) (Membership, int64) {
+	for i := len(r.log) - 1; i >= 0; i-- {
+		entry := r.log[i]
+		if entry.Index > index || entry.Type != EntryConfig {
+			continue
+		}
+		m, err := decodeMembership(entry.Command)
+		if err != nil {
+			log.Printf("Raft: skipping undecodable configuration at index %d: %v\n", entry.Index, err)
+			continue
+		}
+		return m, entry.Index
+	}
+	if r.snapshotMembers != nil {
+		return *r.snapshotMembers, r.snapshotConfigIndex
+	}
+	return r.initialMembers, 0
+}
+
+// setMembership switches the node to a new configuration. Configurations
+// take effect as soon as they are in the log, before they are committed.
+// Callers must hold r.mu.
+func (r *RaftNode) setMembership(m Membership, index int64) {
+	r.members = m.clone()
+
+	// Voters and learners alike receive the log
+	peers := make(map[string]peer, len(m.Voters)+len(m.Learners))
+	for id, addr := range m.Voters {
+		if id != r.nodeID {
+			peers[id] = peer{addr: addr, role: RoleVoter}
+		}
+	}
+	for id, addr := range m.Learners {
+		if id != r.nodeID {
+			peers[id] = peer{addr: addr, role: RoleLearner}
+		}
+	}
+
+	lastIndex, _ := r.lastLogIndexTerm()
+	for id := range r.peers {
+		if _, ok := peers[id]; !ok {
+			delete(r.nextIndex, id)
+			delete(r.matchIndex, id)
+			delete(r.peerSince, id)
+			delete(r.inflight, id)
+			delete(r.pipelined, id)
+		}
+	}
+	// A peer that was removed and added back starts over: it may have lost
+	// its disk in between
+	for id := range peers {
+		if _, ok := r.peers[id]; !ok {
+			r.nextIndex[id] = lastIndex + 1
+			r.matchIndex[id] = 0
+			r.peerSince[id] = index
+			r.inflight[id] = 0
+			r.pipelined[id] = false
+		}
+	}
+	r.peers = peers
+
+	if index != r.configIndex {
+		r.configIndex = index
+		log.Printf("Raft configuration at index %d: voters %v, learners %v\n", index, r.members.Voters, r.members.Learners)
+	}
+}
+
+// isVoter reports whether this node is a voter in its current configuration.
+// Learners and nodes waiting to join never start elections.
+func (r *RaftNode) isVoter() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.members.IsVoter(r.nodeID)
+}
+
+// Membership returns the node's current configuration and the index of the
+// log entry it came from
+func (r *RaftNode) Membership() (Membership, int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.members.clone(), r.configIndex
+}
+
+// PeerInfo describes another member of the configuration
+type PeerInfo struct {
+	ID       string        `json:"id"`
+	Addr     string        `json:"addr"`
+	Role     PeerRole      `json:"role"`
+	Progress *PeerProgress `json:"progress,omitempty"` // leader only
+}
+
+// Peers returns the other members of the node's configuration, sorted by ID
+func (r *RaftNode) Peers() []PeerInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.peerInfos()
+}
+
+// peerInfos lists the other members of the configuration, sorted by ID.
+// Callers must hold r.mu.
+func (r *RaftNode) peerInfos() []PeerInfo {
+	peers := make([]PeerInfo, 0, len(r.peers))
+	for id, p := range r.peers {
+		peers = append(peers, PeerInfo{ID: id, Addr: p.addr, Role: p.role})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// Role returns this node's role in its configuration, or "" while it waits
+// to join a cluster
+func (r *RaftNode) Role() PeerRole {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.members.Role(r.nodeID)
+}
+
+// AddVoter adds a voting member. Adding an existing voter at the same
+// address does nothing.
+func (r *RaftNode) AddVoter(nodeID, addr string) error {
+	return r.changeMembership(func(m *Membership) (bool, error) {
+		if nodeID == "" || addr == "" {
+			return false, fmt.Errorf("%w: node ID and address are required", ErrInvalidConfigChange)
+		}
+		if current, ok := m.Voters[nodeID]; ok && current == addr {
+			return false, nil
+		}
+		if m.IsLearner(nodeID) {
+			return false, fmt.Errorf("%w: %s is a learner, promote it instead", ErrInvalidConfigChange, nodeID)
+		}
+		m.Voters[nodeID] = addr
+		return true, nil
+	})
+}
+
+// AddLearner adds a non-voting member that receives the log but does not
+// count towards elections or commitment
+func (r *RaftNode) AddLearner(nodeID, addr string) error {
+	return r.changeMembership(func(m *Membership) (bool, error) {
+		if nodeID == "" || addr == "" {
+			return false, fmt.Errorf("%w: node ID and address are required", ErrInvalidConfigChange)
+		}
+		if current, ok := m.Learners[nodeID]; ok && current == addr {
+			return false, nil
+		}
+		if m.IsVoter(nodeID) {
+			return false, fmt.Errorf("%w: %s is already a voter", ErrInvalidConfigChange, nodeID)
+		}
+		m.Learners[nodeID] = addr
+		return true, nil
+	})
+}
+
+// PromoteLearner turns a learner into a voter once it has caught up with
+// the leader, so the promotion does not stall commitment
+func (r *RaftNode) PromoteLearner(nodeID string) error {
+	return r.changeMembership(func(m *Membership) (bool, error) {
+		addr, ok := m.Learners[nodeID]
+		if !ok {
+			return false, fmt.Errorf("%w: %s is not a learner", ErrInvalidConfigChange, nodeID)
+		}
+		if lag := r.commitIndex - r.matchIndex[nodeID]; lag > promoteMaxLag {
+			return false, fmt.Errorf("%w: learner %s is %d entries behind", ErrInvalidConfigChange, nodeID, lag)
+		}
+		delete(m.Learners, nodeID)
+		m.Voters[nodeID] = addr
+		return true, nil
+	})
+}
+
+// RemoveNode removes a voter or learner. A leader may remove itself; it
+// steps down once the change has committed.
+func (r *RaftNode) RemoveNode(nodeID string) error {
+	return r.changeMembership(func(m *Membership) (bool, error) {
+		if m.IsLearner(nodeID) {
+			delete(m.Learners, nodeID)
+			return true, nil
+		}
+		if !m.IsVoter(nodeID) {
+			return false, fmt.Errorf("%w: %s is not a member", ErrInvalidConfigChange, nodeID)
+		}
+		if len(m.Voters) == 1 {
+			return false, fmt.Errorf("%w: cannot remove the last voter", ErrInvalidConfigChange)
+		}
+		delete(m.Voters, nodeID)
+		return true, nil
+	})
+}
+
+// changeMembership proposes a configuration derived from the current one
+// and waits for it to commit. Changes add or remove a single server at a
+// time, so any majority of the old configuration overlaps any majority of
+// the new one and only one change may be in flight. change edits a copy of
+// the configuration under r.mu and reports whether anything changed.
+func (r *RaftNode) changeMembership(change func(m *Membership) (bool, error)) error {
+	r.mu.Lock()
+	if r.state != Leader {
+		r.mu.Unlock()
+		return ErrNotLeader
+	}
+	if r.configIndex > r.commitIndex || r.termAt(r.commitIndex) != r.currentTerm {
+		r.mu.Unlock()
+		return ErrConfigChangePending
+	}
+
+	m := r.members.clone()
+	changed, err := change(&m)
+	if err != nil || !changed {
+		r.mu.Unlock()
+		return err
+	}
+	data, err := encodeMembership(m)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	p, err := r.appendProposal(EntryConfig, data)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	r.sendHeartbeats()
+	return r.awaitApplied(p)
+}
+
+// handleJoin adds the caller to the configuration as a voter, or as a
+// learner if it asked to be one. Only the leader can do this; other nodes
+// point the caller at the leader.
+func (r *RaftNode) handleJoin(args *JoinArgs, reply *JoinReply) {
+	// A node an administrator already added as a learner stays one until
+	// it is promoted, and a promoted learner restarted with its old flags
+	// stays a voter
+	var err error
+	members, _ := r.Membership()
+	learnerAddr, isLearner := members.Learners[args.NodeID]
+	voterAddr, isVoter := members.Voters[args.NodeID]
+	switch {
+	case isLearner && learnerAddr == args.Addr:
+	case args.Learner && isVoter && voterAddr == args.Addr:
+	case args.Learner:
+		err = r.AddLearner(args.NodeID, args.Addr)
+	default:
+		err = r.AddVoter(args.NodeID, args.Addr)
+	}
+	if err == nil {
+		members, _ = r.Membership()
+		log.Printf("Raft: %s at %s is a %s of the cluster\n", args.NodeID, args.Addr, members.Role(args.NodeID))
+		reply.Success = true
+		return
+	}
+	if errors.Is(err, ErrNotLeader) {
+		r.mu.RLock()
+		reply.LeaderID = r.leaderID
+		reply.LeaderAddr, _ = r.members.Addr(r.leaderID)
+		r.mu.RUnlock()
+	}
+	reply.Error = err.Error()
+}
+
+// Join asks an existing cluster to add this node under nodeID at addr.
+// target is the Raft address of any member; a follower redirects the request
+// to the leader. Join retries until the change commits or joinTimeout passes.
+func (r *RaftNode) Join(nodeID, addr, target string) error {
+	return r.join(JoinArgs{NodeID: nodeID, Addr: addr}, target)
+}
+
+// JoinAsLearner is Join for a node that should only receive the log, such as
+// a replica for analytics queries
+func (r *RaftNode) JoinAsLearner(nodeID, addr, target string) error {
+	return r.join(JoinArgs{NodeID: nodeID, Addr: addr, Learner: true}, target)
+}
+
+func (r *RaftNode) join(args JoinArgs, target string) error {
+	nodeID := args.NodeID
+	deadline := r.clock.Now().Add(joinTimeout)
+	redirected := false
+
+	for {
+		var reply JoinReply
+		err := r.transport.Join(target, &args, &reply)
+		if err == nil && reply.Success {
+			log.Printf("Node %s joined cluster via %s\n", nodeID, target)
+			return nil
+		}
+		// Follow a redirect straight away, but only once between retries so
+		// nodes with stale leader hints cannot bounce the request forever
+		if err == nil && reply.LeaderAddr != "" && reply.LeaderAddr != target && !redirected {
+			log.Printf("Join redirected to leader %s at %s\n", reply.LeaderID, reply.LeaderAddr)
+			target = reply.LeaderAddr
+			redirected = true
+			continue
+		}
+		if err == nil {
+			err = errors.New(reply.Error)
+		}
+		if r.clock.Now().After(deadline) {
+			return fmt.Errorf("failed to join cluster via %s: %w", target, err)
+		}
+
+		log.Printf("Join via %s failed, retrying: %v\n", target, err)
+		select {
+		case <-r.clock.After(joinRetryInterval):
+			redirected = false
+		case <-r.shutdownCh:
+			return ErrShutdown
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ReadConsistency selects how a read served from the local state machine is
+// ordered with respect to writes
+type ReadConsistency string
+
+const (
+	// ReadLinearizable confirms leadership with a quorum (ReadIndex) before
+	// reading, so the read sees every write acknowledged before it started
+	ReadLinearizable ReadConsistency = "linearizable"
+	// ReadLease skips the quorum round trip while the leader holds a lease
+	ReadLease ReadConsistency = "lease"
+	// ReadStale reads whatever the local node has applied
+	ReadStale ReadConsistency = "stale"
+)
+
+var (
+	// ErrLeadershipUnconfirmed is returned when a leader cannot reach a
+	// quorum to confirm a linearizable read
+	ErrLeadershipUnconfirmed = errors.New("raft: could not confirm leadership with a quorum")
+	// ErrTooStale is returned when a follower is further behind the leader
+	// than a bounded-staleness read allows
+	ErrTooStale = errors.New("raft: replica is too stale for this read")
+)
+
+// Staleness bounds how far behind the leader a follower read may be, either
+// in time or in committed entries not yet applied
+type Staleness struct {
+	MaxAge     time.Duration
+	MaxEntries int64
+}
+
+// ParseStaleness parses a max_staleness value: a duration such as "5s" or
+// "250ms", or a plain number of entries
+func ParseStaleness(s string) (Staleness, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+		return Staleness{MaxEntries: n}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return Staleness{MaxAge: d}, nil
+	}
+	return Staleness{}, fmt.Errorf("invalid max_staleness %q: use a duration like 5s or a number of entries", s)
+}
+
+// ParseReadConsistency parses a consistency level, defaulting to linearizable
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	switch level := ReadConsistency(s); level {
+	case "":
+		return ReadLinearizable, nil
+	case ReadLinearizable, ReadLease, ReadStale:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown consistency %q: use linearizable, lease or stale", s)
+}
+
+// ReadBarrier waits until the local state machine can serve a read at the
+// given consistency level. Linearizable and lease reads are only served by
+// the leader; other nodes return ErrNotLeader.
+func (r *RaftNode) ReadBarrier(level ReadConsistency) error {
+	var index int64
+	var err error
+	switch level {
+	case ReadStale:
+		return nil
+	case ReadLease:
+		var ok bool
+		index, ok, err = r.leaseReadIndex()
+		if err == nil && !ok {
+			// Without a valid lease fall back to a quorum round trip
+			index, err = r.ReadIndex()
+		}
+	default:
+		index, err = r.ReadIndex()
+	}
+	if err != nil {
+		return err
+	}
+	return r.waitApplied(index)
+}
+
+// BoundedStaleRead reports whether the local state machine is within bound
+// of the leader. The leader always is, once it holds a lease or has
+// confirmed its leadership; a follower compares what it has applied with the
+// commit index the leader last reported and returns ErrTooStale if it is
+// too far behind.
+func (r *RaftNode) BoundedStaleRead(bound Staleness) error {
+	r.mu.RLock()
+	if r.state == Leader {
+		r.mu.RUnlock()
+		return r.ReadBarrier(ReadLease)
+	}
+	defer r.mu.RUnlock()
+
+	if bound.MaxAge > 0 {
+		if r.syncedAt.IsZero() || r.clock.Now().Sub(r.syncedAt) > bound.MaxAge {
+			return ErrTooStale
+		}
+		return nil
+	}
+	// The leader's commit index is only a useful yardstick while we are
+	// still hearing from it
+	if !r.leaderAlive() || r.leaderCommit-r.lastApplied > bound.MaxEntries {
+		return ErrTooStale
+	}
+	return nil
+}
+
+// ReadIndex returns the leader's commit index after confirming with a quorum
+// that it is still the leader. Once that index has been applied, a read of
+// the local state machine is linearizable.
+func (r *RaftNode) ReadIndex() (int64, error) {
+	r.mu.Lock()
+	term := r.currentTerm
+	// A new leader only knows the cluster's commit index once an entry of
+	// its own term has committed
+	err := r.waitLocked(applyTimeout, func() bool {
+		return r.state != Leader || r.currentTerm != term || r.termAt(r.commitIndex) == term
+	})
+	if err == nil && (r.state != Leader || r.currentTerm != term) {
+		err = ErrNotLeader
+	}
+	if err != nil {
+		r.mu.Unlock()
+		return 0, err
+	}
+
+	index := r.commitIndex
+	self := 0
+	if r.members.IsVoter(r.nodeID) {
+		self = 1
+	}
+	needed := r.quorum()
+	voters := make(map[string]string, len(r.members.Voters))
+	for id, addr := range r.members.Voters {
+		if id != r.nodeID {
+			voters[id] = addr
+		}
+	}
+	r.mu.Unlock()
+
+	if !r.confirmLeadership(term, index, voters, self, needed) {
+		return 0, ErrLeadershipUnconfirmed
+	}
+	return index, nil
+}
+
+// confirmLeadership sends a heartbeat to every voter and reports whether
+// enough of them, together with self votes, still accept this node as the
+// leader for term
+func (r *RaftNode) confirmLeadership(term, commit int64, voters map[string]string, self, needed int) bool {
+	acks := make(chan bool, len(voters))
+	for id, addr := range voters {
+		go func(id, addr string) {
+			// An empty AppendEntries at index 0 always passes the consistency
+			// check and leaves the follower's log and commit index alone
+			args := AppendEntriesArgs{
+				Term:           term,
+				LeaderID:       r.nodeID,
+				LeaderHTTPAddr: r.httpAddr,
+				LeaderCommit:   commit,
+			}
+			var reply AppendEntriesReply
+			sent := r.clock.Now()
+			err := r.transport.AppendEntries(addr, &args, &reply)
+
+			r.mu.Lock()
+			if err == nil {
+				r.recordAck(id, term, reply.Term, sent)
+				if reply.Term > r.currentTerm {
+					r.becomeFollower(reply.Term)
+					r.resetElectionTimer()
+				}
+			}
+			r.mu.Unlock()
+			acks <- err == nil && reply.Term == term
+		}(id, addr)
+	}
+
+	count := self
+	for i := 0; i < len(voters) && count < needed; i++ {
+		if <-acks {
+			count++
+		}
+	}
+	return count >= needed
+}
+
+// leaseReadIndex returns the commit index if this node holds a valid leader
+// lease, and false if a quorum round trip is needed instead
+func (r *RaftNode) leaseReadIndex() (int64, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.state != Leader {
+		return 0, false, ErrNotLeader
+	}
+	if r.termAt(r.commitIndex) != r.currentTerm || !r.leaseValid() {
+		return 0, false, nil
+	}
+	return r.commitIndex, true, nil
+}
+
+// leaseValid reports whether a quorum of voters has acknowledged an RPC this
+// leader sent within the lease period. Voters ignore other candidates for an
+// election timeout after hearing from the leader, so no other leader can
+// exist until then; the lease ends a little earlier to allow for clock drift.
+// Callers must hold r.mu.
+func (r *RaftNode) leaseValid() bool {
+	now := r.clock.Now()
+	if r.transferTarget != "" || now.Before(r.noLeaseUntil) {
+		return false
+	}
+	acks := make([]time.Time, 0, len(r.members.Voters))
+	for id := range r.members.Voters {
+		if id == r.nodeID {
+			acks = append(acks, now)
+		} else {
+			acks = append(acks, r.lastAck[id])
+		}
+	}
+	quorum := r.quorum()
+	if len(acks) < quorum {
+		return false
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i].After(acks[j]) })
+	return now.Sub(acks[quorum-1]) < r.electionTimeout*9/10
+}
+
+// recordAck notes that peer id acknowledged an RPC sent at sent for term.
+// Callers must hold r.mu.
+func (r *RaftNode) recordAck(id string, term, replyTerm int64, sent time.Time) {
+	if r.state == Leader && r.currentTerm == term && replyTerm == term && sent.After(r.lastAck[id]) {
+		r.lastAck[id] = sent
+	}
+}
+
+// leaderAlive reports whether this node leads or has heard from the leader
+// within the election timeout. Callers must hold r.mu.
+func (r *RaftNode) leaderAlive() bool {
+	if r.state == Leader {
+		return true
+	}
+	return r.leaderID != "" && r.clock.Now().Sub(r.lastLeaderContact) < r.electionTimeout
+}
+
+// waitApplied blocks until the entry at index has been applied locally
+func (r *RaftNode) waitApplied(index int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.waitLocked(applyTimeout, func() bool {
+		return r.lastApplied >= index
+	})
+}
+
+// waitLocked waits on applyCond until done reports true, the timeout passes
+// or the node shuts down. Callers must hold r.mu.
+func (r *RaftNode) waitLocked(timeout time.Duration, done func() bool) error {
+	deadline := r.clock.Now().Add(timeout)
+	timer := r.clock.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		r.applyCond.Broadcast()
+		r.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for !done() {
+		if r.isShutdown() {
+			return ErrShutdown
+		}
+		if !r.clock.Now().Before(deadline) {
+			return ErrApplyTimeout
+		}
+		r.applyCond.Wait()
+	}
+	return nil
+}
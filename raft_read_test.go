@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStaleness(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Staleness
+		wantErr bool
+	}{
+		{in: "5s", want: Staleness{MaxAge: 5 * time.Second}},
+		{in: "250ms", want: Staleness{MaxAge: 250 * time.Millisecond}},
+		{in: "1m30s", want: Staleness{MaxAge: 90 * time.Second}},
+		{in: "100", want: Staleness{MaxEntries: 100}},
+		{in: "0", want: Staleness{}},
+		{in: "0s", want: Staleness{}},
+		{in: "", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "-5s", wantErr: true},
+		{in: "1.5", wantErr: true},
+		{in: "5 s", wantErr: true},
+		{in: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStaleness(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseStaleness(%q) = %+v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseStaleness(%q) = %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// handleAppendEntries accepts heartbeats and log entries from the current leader
+func (r *RaftNode) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if args.Term > r.currentTerm || (args.Term == r.currentTerm && r.state != Follower) {
+		if err := r.becomeFollower(args.Term); err != nil {
+			reply.Term = r.currentTerm
+			return
+		}
+	}
+	reply.Term = r.currentTerm
+	if args.Term < r.currentTerm {
+		return
+	}
+	if err := r.persistHardState(); err != nil {
+		return
+	}
+
+	r.leaderID = args.LeaderID
+	r.leaderHTTPAddr = args.LeaderHTTPAddr
+	r.lastLeaderContact = r.clock.Now()
+	r.resetElectionTimer()
+
+	// Consistency check: our log must contain the entry preceding the new ones
+	lastIndex, _ := r.lastLogIndexTerm()
+	if args.PrevLogIndex > lastIndex {
+		reply.ConflictIndex = lastIndex + 1
+		return
+	}
+	// Entries up to our snapshot are committed and always match the leader
+	if term := r.termAt(args.PrevLogIndex); args.PrevLogIndex > r.snapshotIndex && term != args.PrevLogTerm {
+		// Point the leader at the first entry of the conflicting term so it
+		// can skip the whole term in one round trip
+		index := args.PrevLogIndex
+		for index > r.snapshotIndex+1 && r.termAt(index-1) == term {
+			index--
+		}
+		reply.ConflictTerm = term
+		reply.ConflictIndex = index
+		return
+	}
+
+	// New entries are written to storage before they enter the in-memory
+	// log, so a successful reply always means they are durable
+	changed := false
+	for i, entry := range args.Entries {
+		if entry.Index <= r.snapshotIndex {
+			continue
+		}
+		if entry.Index <= lastIndex {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			// Conflicting entry: drop it and everything after it
+			if err := r.storage.TruncateFrom(entry.Index); err != nil {
+				return
+			}
+			r.log = r.log[:entry.Index-r.snapshotIndex-1]
+		}
+		if err := r.storage.AppendEntries(args.Entries[i:]); err != nil {
+			return
+		}
+		r.log = append(r.log, args.Entries[i:]...)
+		changed = true
+		break
+	}
+	// A configuration entry may have been added or truncated away
+	if changed {
+		r.setMembership(r.latestMembership())
+	}
+
+	if args.LeaderCommit > r.leaderCommit {
+		r.leaderCommit = args.LeaderCommit
+	}
+	if r.lastApplied >= r.leaderCommit {
+		r.syncedAt = r.lastLeaderContact
+	}
+
+	if args.LeaderCommit > r.commitIndex {
+		newLast := args.PrevLogIndex + int64(len(args.Entries))
+		if args.LeaderCommit < newLast {
+			newLast = args.LeaderCommit
+		}
+		if newLast > r.commitIndex {
+			r.commitIndex = newLast
+			r.applyCond.Broadcast()
+		}
+	}
+	reply.Success = true
+}
+
+// sendHeartbeats replicates the log (or an empty heartbeat) to all peers
+func (r *RaftNode) sendHeartbeats() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state != Leader {
+		return
+	}
+	r.lastHeartbeat = r.clock.Now()
+
+	for id, p := range r.peers {
+		if r.replicating[id] {
+			continue
+		}
+		r.replicating[id] = true
+		go r.replicateTo(id, p.addr)
+	}
+}
+
+// replicateTo sends AppendEntries to a single peer until everything in the
+// leader's log has been sent to it. A peer whose log is known to match the
+// leader's is pipelined: up to maxInflight batches go out without waiting
+// for replies, nextIndex moving past each one as it is sent. Until a peer
+// has accepted an append, and after it rejects one, it is probed one batch
+// at a time. Replies restart the loop when there is more to send.
+func (r *RaftNode) replicateTo(id, addr string) {
+	for sent := 0; ; sent++ {
+		r.mu.Lock()
+		if _, ok := r.peers[id]; r.state != Leader || !ok {
+			r.replicating[id] = false
+			r.mu.Unlock()
+			return
+		}
+		since := r.peerSince[id]
+		next := r.nextIndex[id]
+		if next < 1 {
+			next = 1
+		}
+		limit := 1
+		if r.pipelined[id] {
+			limit = r.maxInflight
+		}
+		// The first RPC doubles as the heartbeat, unless appends already in
+		// flight serve as one
+		lastIndex, _ := r.lastLogIndexTerm()
+		if r.inflight[id] >= limit || (next > lastIndex && (sent > 0 || r.inflight[id] > 0)) {
+			r.replicating[id] = false
+			r.mu.Unlock()
+			return
+		}
+		// Entries the peer needs were compacted away: send the snapshot
+		// instead, once the appends in flight have been answered
+		if next <= r.snapshotIndex {
+			if r.inflight[id] > 0 {
+				r.replicating[id] = false
+				r.mu.Unlock()
+				return
+			}
+			r.mu.Unlock()
+			if !r.sendSnapshot(id, addr) {
+				r.mu.Lock()
+				r.replicating[id] = false
+				r.mu.Unlock()
+				return
+			}
+			continue
+		}
+		args := AppendEntriesArgs{
+			Term:           r.currentTerm,
+			LeaderID:       r.nodeID,
+			LeaderHTTPAddr: r.httpAddr,
+			PrevLogIndex:   next - 1,
+			PrevLogTerm:    r.termAt(next - 1),
+			Entries:        r.entriesFrom(next, maxAppendEntries),
+			LeaderCommit:   r.commitIndex,
+		}
+		r.inflight[id]++
+		if r.pipelined[id] {
+			r.nextIndex[id] = next + int64(len(args.Entries))
+		}
+		r.mu.Unlock()
+
+		go r.sendAppend(id, addr, since, &args)
+	}
+}
+
+// sendAppend sends one AppendEntries RPC and processes the reply, restarting
+// replicateTo if the peer still has entries to receive
+func (r *RaftNode) sendAppend(id, addr string, since int64, args *AppendEntriesArgs) {
+	var reply AppendEntriesReply
+	sent := r.clock.Now()
+	err := r.transport.AppendEntries(addr, args, &reply)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.recordAck(id, args.Term, reply.Term, sent)
+		if reply.Term > r.currentTerm {
+			r.becomeFollower(reply.Term)
+			r.resetElectionTimer()
+			return
+		}
+	}
+	// Counts start over for a new term or a re-added peer
+	if r.currentTerm != args.Term || !r.samePeer(id, since) {
+		return
+	}
+	r.inflight[id]--
+	if err != nil {
+		// Resend from the last acknowledged entry on the next heartbeat
+		if r.pipelined[id] {
+			r.pipelined[id] = false
+			r.nextIndex[id] = r.matchIndex[id] + 1
+		}
+		return
+	}
+	if !r.handleAppendEntriesReply(id, args, &reply) {
+		return
+	}
+	r.pipelined[id] = reply.Success
+
+	lastIndex, _ := r.lastLogIndexTerm()
+	if r.nextIndex[id] <= lastIndex && !r.replicating[id] {
+		r.replicating[id] = true
+		go r.replicateTo(id, addr)
+	}
+}
+
+// samePeer reports whether id is still the member that was added at since,
+// so a reply sent before it was removed and added back is not mistaken for
+// progress of the new member. Callers must hold r.mu.
+func (r *RaftNode) samePeer(id string, since int64) bool {
+	current, ok := r.peerSince[id]
+	return ok && current == since
+}
+
+// handleAppendEntriesReply updates replication progress for a peer. It
+// reports whether the leader should keep sending to it.
+// Callers must hold r.mu.
+func (r *RaftNode) handleAppendEntriesReply(id string, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term)
+		r.resetElectionTimer()
+		return false
+	}
+	if r.state != Leader || r.currentTerm != args.Term {
+		return false
+	}
+
+	if reply.Success {
+		match := args.PrevLogIndex + int64(len(args.Entries))
+		if match > r.matchIndex[id] {
+			r.matchIndex[id] = match
+			// Wake a leadership transfer waiting for this peer
+			r.applyCond.Broadcast()
+		}
+		if r.nextIndex[id] < r.matchIndex[id]+1 {
+			r.nextIndex[id] = r.matchIndex[id] + 1
+		}
+		r.advanceCommitIndex()
+		return true
+	}
+
+	// The follower's log diverges; back up using its conflict hint
+	next := reply.ConflictIndex
+	if reply.ConflictTerm > 0 {
+		for i := args.PrevLogIndex; i > r.snapshotIndex; i-- {
+			term := r.termAt(i)
+			if term == reply.ConflictTerm {
+				next = i + 1
+				break
+			}
+			if term < reply.ConflictTerm {
+				break
+			}
+		}
+	}
+	if next <= r.matchIndex[id] {
+		next = r.matchIndex[id] + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	r.nextIndex[id] = next
+	return true
+}
+
+// advanceCommitIndex commits the highest entry from the current term that
+// a majority of the voters has stored.
+// Callers must hold r.mu.
+func (r *RaftNode) advanceCommitIndex() {
+	lastIndex, _ := r.lastLogIndexTerm()
+	for n := lastIndex; n > r.commitIndex; n-- {
+		// Only entries from the current term are committed by counting replicas
+		if r.termAt(n) != r.currentTerm {
+			return
+		}
+		count := 0
+		for id := range r.members.Voters {
+			if id == r.nodeID || r.matchIndex[id] >= n {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.commitIndex = n
+			r.applyCond.Broadcast()
+			break
+		}
+	}
+
+	// A leader that has removed itself hands over once the change commits
+	if r.state == Leader && !r.members.IsVoter(r.nodeID) && r.configIndex <= r.commitIndex {
+		r.becomeFollower(r.currentTerm)
+	}
+}
+
+// runApplier applies committed entries in log order and wakes waiting
+// clients. Entries that committed together are applied as one batch.
+func (r *RaftNode) runApplier() {
+	for {
+		r.mu.Lock()
+		for r.lastApplied >= r.commitIndex && !r.isShutdown() {
+			r.applyCond.Wait()
+		}
+		if r.isShutdown() {
+			r.mu.Unlock()
+			return
+		}
+		entries := r.entriesFrom(r.lastApplied+1, maxAppendEntries)
+		if n := r.commitIndex - r.lastApplied; int64(len(entries)) > n {
+			entries = entries[:n]
+		}
+		r.mu.Unlock()
+
+		r.applyMu.Lock()
+		// An installed snapshot may already cover some of the entries
+		r.mu.RLock()
+		for len(entries) > 0 && entries[0].Index <= r.lastApplied {
+			entries = entries[1:]
+		}
+		r.mu.RUnlock()
+
+		errs := r.applyEntries(entries)
+
+		r.mu.Lock()
+		for i, entry := range entries {
+			r.lastApplied = entry.Index
+			if p, ok := r.pending[entry.Index]; ok {
+				delete(r.pending, entry.Index)
+				if p.term != entry.Term {
+					p.done <- ErrLeadershipLost
+				} else {
+					p.done <- errs[i]
+				}
+			}
+		}
+		if r.lastApplied >= r.leaderCommit && r.state == Follower {
+			r.syncedAt = r.lastLeaderContact
+		}
+		r.applyCond.Broadcast()
+		r.mu.Unlock()
+		r.maybeSnapshot()
+		r.applyMu.Unlock()
+	}
+}
+
+// applyEntries feeds committed entries into DBEngine and CRDTStore and
+// returns the result of each. Entries are applied in log order, so every
+// replica reaches the same state.
+func (r *RaftNode) applyEntries(entries []LogEntry) []error {
+	errs := make([]error, len(entries))
+	var cmds []CommittedCommand
+	var pos []int
+	for i, entry := range entries {
+		// Configuration entries took effect when they were appended
+		if entry.Type == EntryConfig || len(entry.Command) == 0 {
+			continue
+		}
+		cmd, err := decodeCommand(entry.Command)
+		if err != nil {
+			log.Printf("Raft: skipping undecodable entry %d: %v\n", entry.Index, err)
+			errs[i] = err
+			continue
+		}
+		cmds = append(cmds, CommittedCommand{Index: entry.Index, Command: cmd})
+		pos = append(pos, i)
+	}
+	if len(cmds) == 0 {
+		return errs
+	}
+
+	// Keep transaction times increasing across leadership changes
+	r.mu.Lock()
+	for _, c := range cmds {
+		if c.Command.TxTime.After(r.lastTxTime) {
+			r.lastTxTime = c.Command.TxTime
+		}
+	}
+	r.mu.Unlock()
+
+	for i, err := range applyCommands(r.db, r.crdtStore, cmds) {
+		if errors.Is(err, ErrWALWrite) {
+			// The other replicas stored the entry. Moving past it would leave
+			// this one diverged for good, as a restart only re-applies
+			// entries after the last one applied.
+			log.Fatalf("Raft: failed to persist entry %d, stopping: %v", cmds[i].Index, err)
+		}
+		if err != nil {
+			log.Printf("Raft: failed to apply entry %d: %v\n", cmds[i].Index, err)
+			errs[pos[i]] = err
+		}
+	}
+	log.Printf("Raft applied %d commands at indexes %d-%d\n", len(cmds), cmds[0].Index, cmds[len(cmds)-1].Index)
+	return errs
+}
+
+// isShutdown reports whether Shutdown has been called
+func (r *RaftNode) isShutdown() bool {
+	select {
+	case <-r.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+// RequestVoteArgs is sent by candidates to gather votes
+type RequestVoteArgs struct {
+	Term         int64  `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex int64  `json:"last_log_index"`
+	LastLogTerm  int64  `json:"last_log_term"`
+	// PreVote asks whether the vote would be granted, without the receiver
+	// changing its term or recording a vote
+	PreVote bool `json:"pre_vote,omitempty"`
+	// LeadershipTransfer marks an election the leader asked for with
+	// TimeoutNow, so voters answer even while they hear from that leader
+	LeadershipTransfer bool `json:"leadership_transfer,omitempty"`
+}
+
+// RequestVoteReply is the response to RequestVote
+type RequestVoteReply struct {
+	Term        int64 `json:"term"`
+	VoteGranted bool  `json:"vote_granted"`
+}
+
+// AppendEntriesArgs is sent by the leader to replicate entries; with no
+// entries it doubles as a heartbeat
+type AppendEntriesArgs struct {
+	Term           int64      `json:"term"`
+	LeaderID       string     `json:"leader_id"`
+	LeaderHTTPAddr string     `json:"leader_http_addr,omitempty"`
+	PrevLogIndex   int64      `json:"prev_log_index"`
+	PrevLogTerm    int64      `json:"prev_log_term"`
+	Entries        []LogEntry `json:"entries,omitempty"`
+	LeaderCommit   int64      `json:"leader_commit"`
+}
+
+// AppendEntriesReply is the response to AppendEntries. On a failed
+// consistency check ConflictIndex and ConflictTerm tell the leader where the
+// follower's log diverges.
+type AppendEntriesReply struct {
+	Term          int64 `json:"term"`
+	Success       bool  `json:"success"`
+	ConflictIndex int64 `json:"conflict_index,omitempty"`
+	ConflictTerm  int64 `json:"conflict_term,omitempty"`
+}
+
+// InstallSnapshotArgs carries a full snapshot to a follower whose next
+// entry has already been compacted out of the leader's log
+type InstallSnapshotArgs struct {
+	Term              int64  `json:"term"`
+	LeaderID          string `json:"leader_id"`
+	LeaderHTTPAddr    string `json:"leader_http_addr,omitempty"`
+	LastIncludedIndex int64  `json:"last_included_index"`
+	LastIncludedTerm  int64  `json:"last_included_term"`
+	Data              []byte `json:"data"`
+}
+
+// InstallSnapshotReply is the response to InstallSnapshot
+type InstallSnapshotReply struct {
+	Term int64 `json:"term"`
+}
+
+// JoinArgs asks the leader to add a node to the cluster configuration
+type JoinArgs struct {
+	NodeID  string `json:"node_id"`
+	Addr    string `json:"addr"`
+	Learner bool   `json:"learner,omitempty"`
+}
+
+// JoinReply is the response to Join. A node that is not the leader fails
+// the request and points the caller at the leader it knows about, if any.
+type JoinReply struct {
+	Success    bool   `json:"success"`
+	LeaderID   string `json:"leader_id,omitempty"`
+	LeaderAddr string `json:"leader_addr,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// TimeoutNowArgs tells the target of a leadership transfer to start an
+// election at once
+type TimeoutNowArgs struct {
+	Term     int64  `json:"term"`
+	LeaderID string `json:"leader_id"`
+}
+
+// TimeoutNowReply is the response to TimeoutNow. Success is false when the
+// target cannot stand for election, for example because it is not a voter.
+type TimeoutNowReply struct {
+	Term    int64 `json:"term"`
+	Success bool  `json:"success"`
+}
+
+// RPCHandler serves Raft RPCs delivered by a Transport; RaftNode implements it
+type RPCHandler interface {
+	handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply)
+	handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply)
+	handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply)
+	handleJoin(args *JoinArgs, reply *JoinReply)
+	handleTimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply)
+}
+
+// Transport carries Raft RPCs between nodes. addr is the peer's Raft
+// address as recorded in the cluster configuration. An error means the
+// RPC may not have been delivered and no reply was received.
+type Transport interface {
+	// Serve starts delivering incoming RPCs to handler
+	Serve(handler RPCHandler) error
+	RequestVote(addr string, args *RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(addr string, args *AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(addr string, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error
+	// Join may block until a membership change commits, so implementations
+	// allow it more time than the other RPCs
+	Join(addr string, args *JoinArgs, reply *JoinReply) error
+	TimeoutNow(addr string, args *TimeoutNowArgs, reply *TimeoutNowReply) error
+	// Close stops serving incoming RPCs
+	Close() error
+}
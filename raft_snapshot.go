@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// raftSnapshot is the replicated state machine captured at a log index: the
+// DBEngine records plus the CRDTStore state, and the cluster configuration
+// in effect at that index
+type raftSnapshot struct {
+	LastIndex   int64                       `json:"last_index"`
+	LastTerm    int64                       `json:"last_term"`
+	Members     *Membership                 `json:"members,omitempty"`
+	ConfigIndex int64                       `json:"config_index,omitempty"`
+	Records     map[string][]TemporalRecord `json:"records"`
+	CRDT        CRDTState                   `json:"crdt"`
+}
+
+// loadRaftSnapshot reads the stored snapshot, returning nil if there is none
+func loadRaftSnapshot(storage *RaftStorage) (*raftSnapshot, error) {
+	data, err := storage.LoadSnapshot()
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var snap raftSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode raft snapshot: %w", err)
+	}
+	return &snap, nil
+}
+
+// recoverSnapshot restores the state machine from the snapshot found at
+// startup. It runs before any background goroutine is started.
+func (r *RaftNode) recoverSnapshot(snap *raftSnapshot) error {
+	if snap.LastIndex < r.snapshotIndex {
+		return fmt.Errorf("raft snapshot at index %d is older than the compacted log (%d)", snap.LastIndex, r.snapshotIndex)
+	}
+
+	// A crash between saving the snapshot and compacting the log leaves
+	// entries the snapshot already covers
+	if snap.LastIndex > r.snapshotIndex {
+		var remaining []LogEntry
+		if r.termAt(snap.LastIndex) == snap.LastTerm {
+			remaining = r.entriesFrom(snap.LastIndex+1, len(r.log))
+		}
+		if err := r.storage.Compact(snap.LastIndex, remaining); err != nil {
+			return err
+		}
+		r.log = remaining
+	}
+	r.snapshotIndex = snap.LastIndex
+	r.snapshotTerm = snap.LastTerm
+	r.snapshotMembers = snap.Members
+	r.snapshotConfigIndex = snap.ConfigIndex
+
+	// The CRDT store only lives in memory; the DBEngine keeps its own copy on
+	// disk and only needs the snapshot if it is behind
+	r.crdtStore.Restore(snap.CRDT)
+	if r.db.AppliedIndex() < snap.LastIndex {
+		if err := r.db.Restore(snap.Records, snap.LastIndex); err != nil {
+			return fmt.Errorf("failed to restore database from raft snapshot: %w", err)
+		}
+	}
+	r.commitIndex = snap.LastIndex
+	r.lastApplied = snap.LastIndex
+	return nil
+}
+
+// maybeSnapshot compacts the log once it holds snapshotThreshold applied
+// entries beyond the last snapshot. Callers must hold r.applyMu so the state
+// machine matches lastApplied.
+func (r *RaftNode) maybeSnapshot() {
+	r.mu.RLock()
+	index := r.lastApplied
+	term := r.termAt(index)
+	due := r.snapshotThreshold > 0 && index-r.snapshotIndex >= r.snapshotThreshold
+	r.mu.RUnlock()
+
+	if !due {
+		return
+	}
+	if err := r.takeSnapshot(index, term); err != nil {
+		log.Printf("Raft: snapshot at index %d failed: %v\n", index, err)
+	}
+}
+
+// takeSnapshot saves the state machine at index and discards the log prefix.
+// Callers must hold r.applyMu.
+func (r *RaftNode) takeSnapshot(index, term int64) error {
+	r.mu.RLock()
+	members, configIndex := r.membershipAt(index)
+	members = members.clone()
+	r.mu.RUnlock()
+
+	records, _ := r.db.SnapshotData()
+	data, err := json.Marshal(raftSnapshot{
+		LastIndex:   index,
+		LastTerm:    term,
+		Members:     &members,
+		ConfigIndex: configIndex,
+		Records:     records,
+		CRDT:        r.crdtStore.Snapshot(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode raft snapshot: %w", err)
+	}
+	if err := r.storage.SaveSnapshot(data); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	remaining := r.entriesFrom(index+1, len(r.log))
+	if err := r.storage.Compact(index, remaining); err != nil {
+		return err
+	}
+	r.log = remaining
+	r.snapshotIndex = index
+	r.snapshotTerm = term
+	r.snapshotMembers = &members
+	r.snapshotConfigIndex = configIndex
+	log.Printf("Raft snapshot taken at index %d, %d entries left in log\n", index, len(remaining))
+	return nil
+}
+
+// sendSnapshot installs the stored snapshot on a peer that is too far
+// behind to be caught up from the log. It reports whether replication to the
+// peer should continue.
+func (r *RaftNode) sendSnapshot(id, addr string) bool {
+	r.mu.RLock()
+	if r.state != Leader {
+		r.mu.RUnlock()
+		return false
+	}
+	term := r.currentTerm
+	since := r.peerSince[id]
+	r.mu.RUnlock()
+
+	data, err := r.storage.LoadSnapshot()
+	if err != nil || data == nil {
+		return false
+	}
+	var header struct {
+		LastIndex int64 `json:"last_index"`
+		LastTerm  int64 `json:"last_term"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return false
+	}
+
+	args := InstallSnapshotArgs{
+		Term:              term,
+		LeaderID:          r.nodeID,
+		LeaderHTTPAddr:    r.httpAddr,
+		LastIncludedIndex: header.LastIndex,
+		LastIncludedTerm:  header.LastTerm,
+		Data:              data,
+	}
+	var reply InstallSnapshotReply
+	sent := r.clock.Now()
+	if err := r.transport.InstallSnapshot(addr, &args, &reply); err != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.recordAck(id, term, reply.Term, sent)
+
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term)
+		r.resetElectionTimer()
+		return false
+	}
+	if r.state != Leader || r.currentTerm != term || !r.samePeer(id, since) {
+		return false
+	}
+	if args.LastIncludedIndex > r.matchIndex[id] {
+		r.matchIndex[id] = args.LastIncludedIndex
+		r.applyCond.Broadcast()
+	}
+	r.nextIndex[id] = r.matchIndex[id] + 1
+	log.Printf("Raft installed snapshot at index %d on %s\n", args.LastIncludedIndex, id)
+	r.advanceCommitIndex()
+	return true
+}
+
+// handleInstallSnapshot replaces the local state machine with the leader's snapshot
+func (r *RaftNode) handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if args.Term > r.currentTerm || (args.Term == r.currentTerm && r.state != Follower) {
+		if err := r.becomeFollower(args.Term); err != nil {
+			reply.Term = r.currentTerm
+			return
+		}
+	}
+	reply.Term = r.currentTerm
+	if args.Term < r.currentTerm {
+		return
+	}
+	if err := r.persistHardState(); err != nil {
+		return
+	}
+	r.leaderID = args.LeaderID
+	r.leaderHTTPAddr = args.LeaderHTTPAddr
+	r.lastLeaderContact = r.clock.Now()
+	r.resetElectionTimer()
+
+	index := args.LastIncludedIndex
+	if index <= r.snapshotIndex {
+		return
+	}
+
+	var snap raftSnapshot
+	if err := json.Unmarshal(args.Data, &snap); err != nil {
+		log.Printf("Raft: rejecting undecodable snapshot from %s: %v\n", args.LeaderID, err)
+		return
+	}
+
+	// Take the snapshot's state before compacting away the entries the state
+	// machine would otherwise still need. Restore replaces the records in
+	// memory before persisting them, so a failure leaves nothing consistent to
+	// carry on with.
+	if r.lastApplied < index {
+		if err := r.db.Restore(snap.Records, index); err != nil {
+			log.Fatalf("Raft: failed to restore database from snapshot at index %d, stopping: %v", index, err)
+		}
+		r.crdtStore.Restore(snap.CRDT)
+		r.lastApplied = index
+	}
+	if r.commitIndex < index {
+		r.commitIndex = index
+	}
+
+	if err := r.storage.SaveSnapshot(args.Data); err != nil {
+		return
+	}
+
+	// Keep any entries that follow the snapshot if our log agrees with it
+	var remaining []LogEntry
+	if _, ok := r.entryAt(index); ok && r.termAt(index) == args.LastIncludedTerm {
+		remaining = r.entriesFrom(index+1, len(r.log))
+	}
+	if err := r.storage.Compact(index, remaining); err != nil {
+		return
+	}
+	r.log = remaining
+	r.snapshotIndex = index
+	r.snapshotTerm = args.LastIncludedTerm
+	r.snapshotMembers = snap.Members
+	r.snapshotConfigIndex = snap.ConfigIndex
+	r.setMembership(r.latestMembership())
+	log.Printf("Raft installed snapshot at index %d from %s\n", index, args.LeaderID)
+}
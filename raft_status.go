@@ -0,0 +1,67 @@
+package main
+
+// RaftStatus is a node's view of the log and the cluster at one moment
+type RaftStatus struct {
+	State         string     `json:"raft_state"`
+	Term          int64      `json:"raft_term"`
+	Role          PeerRole   `json:"raft_role"`
+	LeaderID      string     `json:"leader_id"`
+	LeaderAddr    string     `json:"leader_addr"`
+	CommitIndex   int64      `json:"commit_index"`
+	LastApplied   int64      `json:"last_applied"`
+	LastLogIndex  int64      `json:"last_log_index"`
+	LogSize       int        `json:"log_size"` // entries kept after the snapshot
+	SnapshotIndex int64      `json:"snapshot_index"`
+	Peers         []PeerInfo `json:"peers"`
+}
+
+// PeerProgress is the leader's record of how far a peer's log has come
+type PeerProgress struct {
+	MatchIndex    int64 `json:"match_index"`
+	NextIndex     int64 `json:"next_index"`
+	Inflight      int   `json:"inflight"`        // AppendEntries RPCs awaiting a reply
+	LastContactMS int64 `json:"last_contact_ms"` // since the peer acknowledged an RPC sent at that time; -1 if it never has
+	Lag           int64 `json:"lag"`             // entries of the leader's log the peer does not have
+}
+
+// Status returns the node's state, its log positions and its peers. On the
+// leader every peer carries its replication progress.
+func (r *RaftNode) Status() RaftStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	lastIndex, _ := r.lastLogIndexTerm()
+	status := RaftStatus{
+		State:         r.state.String(),
+		Term:          r.currentTerm,
+		Role:          r.members.Role(r.nodeID),
+		LeaderID:      r.leaderID,
+		LeaderAddr:    r.leaderHTTPAddr,
+		CommitIndex:   r.commitIndex,
+		LastApplied:   r.lastApplied,
+		LastLogIndex:  lastIndex,
+		LogSize:       len(r.log),
+		SnapshotIndex: r.snapshotIndex,
+		Peers:         r.peerInfos(),
+	}
+	if r.state != Leader {
+		return status
+	}
+
+	now := r.clock.Now()
+	for i := range status.Peers {
+		id := status.Peers[i].ID
+		progress := &PeerProgress{
+			MatchIndex:    r.matchIndex[id],
+			NextIndex:     r.nextIndex[id],
+			Inflight:      r.inflight[id],
+			LastContactMS: -1,
+			Lag:           lastIndex - r.matchIndex[id],
+		}
+		if ack, ok := r.lastAck[id]; ok && !ack.IsZero() {
+			progress.LastContactMS = now.Sub(ack).Milliseconds()
+		}
+		status.Peers[i].Progress = progress
+	}
+	return status
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// HardState is the Raft state that must survive a restart before the node
+// answers any RPC
+type HardState struct {
+	CurrentTerm int64  `json:"current_term"`
+	VotedFor    string `json:"voted_for"`
+}
+
+// raftLogRecord is one change to the Raft log as stored in the WAL. A
+// "reset" record replaces the whole log with Entries following Index, and is
+// written after a snapshot compacts the log.
+type raftLogRecord struct {
+	Op      string     `json:"op"`
+	Index   int64      `json:"index,omitempty"`
+	Entries []LogEntry `json:"entries,omitempty"`
+}
+
+// RaftStorage keeps the Raft hard state and log entries under the node's
+// data directory. The log is kept in a WAL that fsyncs every append; the hard
+// state is a small snapshot file replaced atomically on every change.
+type RaftStorage struct {
+	dir string
+	wal *WAL
+}
+
+// OpenRaftStorage opens (or creates) the Raft storage in dataDir/raft
+func OpenRaftStorage(dataDir string) (*RaftStorage, error) {
+	dir := filepath.Join(dataDir, "raft")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create raft directory: %w", err)
+	}
+
+	wal, err := OpenWAL(filepath.Join(dir, "log"), WALOptions{SyncPolicy: SyncAlways})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	return &RaftStorage{dir: dir, wal: wal}, nil
+}
+
+// LoadHardState returns the persisted term and vote, or zero values on first start
+func (s *RaftStorage) LoadHardState() (HardState, error) {
+	var hs HardState
+	payload, _, err := readSnapshotFile(filepath.Join(s.dir, "state"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return hs, nil
+		}
+		return hs, fmt.Errorf("failed to read raft state: %w", err)
+	}
+	if err := json.Unmarshal(payload, &hs); err != nil {
+		return hs, fmt.Errorf("failed to decode raft state: %w", err)
+	}
+	return hs, nil
+}
+
+// SaveHardState durably replaces the persisted term and vote
+func (s *RaftStorage) SaveHardState(hs HardState) error {
+	payload, err := json.Marshal(hs)
+	if err != nil {
+		return fmt.Errorf("failed to encode raft state: %w", err)
+	}
+	return writeSnapshotFile(filepath.Join(s.dir, "state"), payload, false)
+}
+
+// AppendEntries durably appends entries to the end of the log
+func (s *RaftStorage) AppendEntries(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return s.write(raftLogRecord{Op: "append", Entries: entries})
+}
+
+// TruncateFrom durably discards the entry at index and everything after it
+func (s *RaftStorage) TruncateFrom(index int64) error {
+	return s.write(raftLogRecord{Op: "truncate", Index: index})
+}
+
+func (s *RaftStorage) write(rec raftLogRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode raft log record: %w", err)
+	}
+	if _, err := s.wal.Append(payload); err != nil {
+		return fmt.Errorf("failed to persist raft log: %w", err)
+	}
+	return nil
+}
+
+// LoadLog rebuilds the log by replaying every stored change. It returns the
+// index preceding the first entry, which is non-zero once the log has been
+// compacted.
+func (s *RaftStorage) LoadLog() (int64, []LogEntry, error) {
+	var base int64
+	entries := []LogEntry{}
+	err := s.wal.Replay(0, func(lsn uint64, payload []byte) error {
+		var rec raftLogRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return fmt.Errorf("failed to decode raft log record %d: %w", lsn, err)
+		}
+
+		switch rec.Op {
+		case "append":
+			for _, entry := range rec.Entries {
+				if entry.Index <= base {
+					continue
+				}
+				if pos := entry.Index - base - 1; pos < int64(len(entries)) {
+					entries = entries[:pos]
+				}
+				if entry.Index != base+int64(len(entries))+1 {
+					return fmt.Errorf("raft log record %d: entry %d does not follow %d",
+						lsn, entry.Index, base+int64(len(entries)))
+				}
+				entries = append(entries, entry)
+			}
+		case "truncate":
+			if pos := rec.Index - base - 1; pos >= 0 && pos < int64(len(entries)) {
+				entries = entries[:pos]
+			}
+		case "reset":
+			base = rec.Index
+			entries = append([]LogEntry{}, rec.Entries...)
+		default:
+			return fmt.Errorf("unknown raft log operation %q at LSN %d", rec.Op, lsn)
+		}
+		return nil
+	})
+	return base, entries, err
+}
+
+// Compact rewrites the log as the entries following base and drops the WAL
+// segments that held the discarded prefix
+func (s *RaftStorage) Compact(base int64, entries []LogEntry) error {
+	if err := s.wal.Rotate(); err != nil {
+		return err
+	}
+	first := s.wal.NextLSN()
+	if err := s.write(raftLogRecord{Op: "reset", Index: base, Entries: entries}); err != nil {
+		return err
+	}
+	return s.wal.RemoveBefore(first)
+}
+
+// LoadSnapshot returns the encoded snapshot, or nil if none has been taken
+func (s *RaftStorage) LoadSnapshot() ([]byte, error) {
+	payload, _, err := readSnapshotFile(filepath.Join(s.dir, "snapshot"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read raft snapshot: %w", err)
+	}
+	return payload, nil
+}
+
+// SaveSnapshot durably replaces the stored snapshot
+func (s *RaftStorage) SaveSnapshot(data []byte) error {
+	return writeSnapshotFile(filepath.Join(s.dir, "snapshot"), data, false)
+}
+
+// Close flushes and closes the underlying log
+func (s *RaftStorage) Close() error {
+	return s.wal.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+var (
+	// ErrInvalidTransfer is returned when the target of a leadership
+	// transfer cannot become leader
+	ErrInvalidTransfer = errors.New("raft: invalid leadership transfer")
+	// ErrTransferInProgress is returned for writes, configuration changes
+	// and new transfers while the leader is handing over leadership
+	ErrTransferInProgress = errors.New("raft: leadership transfer in progress")
+	// ErrTransferTimeout is returned when the target did not take over
+	// within an election timeout; the leader keeps its role
+	ErrTransferTimeout = errors.New("raft: leadership transfer timed out")
+)
+
+// TransferLeadership hands leadership to the voter to, or to the most up to
+// date voter if to is empty. The leader stops accepting writes, brings the
+// target's log up to date and tells it to start an election at once with
+// TimeoutNow. It returns once this node has stepped down, or
+// ErrTransferTimeout if the target did not win within an election timeout.
+func (r *RaftNode) TransferLeadership(to string) error {
+	r.mu.Lock()
+	if r.state != Leader {
+		r.mu.Unlock()
+		return ErrNotLeader
+	}
+	if r.transferTarget != "" {
+		r.mu.Unlock()
+		return ErrTransferInProgress
+	}
+	if to == "" {
+		to = r.transferCandidate()
+		if to == "" {
+			r.mu.Unlock()
+			return fmt.Errorf("%w: there is no other voter", ErrInvalidTransfer)
+		}
+	}
+	if to == r.nodeID {
+		r.mu.Unlock()
+		return nil
+	}
+	addr, ok := r.members.Voters[to]
+	if !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("%w: %s is not a voter", ErrInvalidTransfer, to)
+	}
+	term := r.currentTerm
+	r.transferTarget = to
+	r.mu.Unlock()
+
+	log.Printf("Node %s transferring leadership to %s in term %d\n", r.nodeID, to, term)
+	err := r.transferTo(to, addr, term)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transferTarget = ""
+	if err != nil && r.state == Leader && r.currentTerm == term {
+		// The target may still win an election it started, and voters may
+		// have granted it their vote while they heard from us: serve no
+		// lease reads until that election would have timed out
+		r.noLeaseUntil = r.clock.Now().Add(r.electionTimeout)
+		log.Printf("Leadership transfer to %s failed: %v\n", to, err)
+		return err
+	}
+	log.Printf("Node %s handed leadership over to %s\n", r.nodeID, to)
+	return nil
+}
+
+// transferTo catches the target up and sends it TimeoutNow, then waits for
+// this node to step down
+func (r *RaftNode) transferTo(to, addr string, term int64) error {
+	stillLeader := func() bool {
+		return r.state == Leader && r.currentTerm == term
+	}
+
+	r.sendHeartbeats()
+	r.mu.Lock()
+	err := r.waitLocked(r.electionTimeout, func() bool {
+		last, _ := r.lastLogIndexTerm()
+		return !stillLeader() || r.matchIndex[to] >= last
+	})
+	if err == nil && !stillLeader() {
+		err = ErrLeadershipLost
+	}
+	r.mu.Unlock()
+	if errors.Is(err, ErrApplyTimeout) {
+		return fmt.Errorf("%w: %s did not catch up with the log", ErrTransferTimeout, to)
+	}
+	if err != nil {
+		return err
+	}
+
+	args := TimeoutNowArgs{Term: term, LeaderID: r.nodeID}
+	var reply TimeoutNowReply
+	if err := r.transport.TimeoutNow(addr, &args, &reply); err != nil {
+		return fmt.Errorf("failed to send TimeoutNow to %s: %w", to, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term)
+		r.resetElectionTimer()
+		return nil
+	}
+	if !reply.Success {
+		return fmt.Errorf("%w: %s refused to start an election", ErrInvalidTransfer, to)
+	}
+	// The target's vote request deposes us as soon as it arrives
+	err = r.waitLocked(r.electionTimeout, func() bool { return !stillLeader() })
+	if errors.Is(err, ErrApplyTimeout) {
+		return ErrTransferTimeout
+	}
+	return err
+}
+
+// transferCandidate returns the voter with the most of the log, ties going
+// to the lowest ID, or "" if this node is the only voter.
+// Callers must hold r.mu.
+func (r *RaftNode) transferCandidate() string {
+	ids := make([]string, 0, len(r.members.Voters))
+	for id := range r.members.Voters {
+		if id != r.nodeID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	best := ""
+	for _, id := range ids {
+		if best == "" || r.matchIndex[id] > r.matchIndex[best] {
+			best = id
+		}
+	}
+	return best
+}
+
+// handleTimeoutNow starts an election straight away at the request of the
+// leader handing over to this node. The leader only hands over to a node that
+// has its whole log, so the request must come from the leader this node
+// follows in the current term; anything else is stale or bogus and would
+// only depose a healthy leader.
+func (r *RaftNode) handleTimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) {
+	r.mu.Lock()
+	reply.Term = r.currentTerm
+	if args.Term != r.currentTerm || args.LeaderID != r.leaderID || r.state != Follower || !r.members.IsVoter(r.nodeID) {
+		log.Printf("Node %s ignoring TimeoutNow from %s in term %d (term %d, leader %q)\n",
+			r.nodeID, args.LeaderID, args.Term, r.currentTerm, r.leaderID)
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+
+	log.Printf("Node %s received TimeoutNow from %s in term %d\n", r.nodeID, args.LeaderID, args.Term)
+	reply.Success = true
+	go r.startElection(true)
+}
@@ -0,0 +1,939 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	simSeed  = flag.Int64("sim.seed", 0, "replay the simulation with this seed only")
+	simSeeds = flag.Int("sim.seeds", 3, "number of seeds the simulation runs")
+	simSteps = flag.Int("sim.steps", 300, "scheduling decisions per simulation run")
+)
+
+const (
+	// simNodes is the size of the simulated cluster; it tolerates one fault
+	simNodes = 3
+	// settlePoll and settleRounds decide when the cluster has stopped moving:
+	// its fingerprint must stay the same for settleRounds polls in a row
+	settlePoll   = 200 * time.Microsecond
+	settleRounds = 5
+	// finishRounds bounds the fault-free phase at the end of a run
+	finishRounds = 4000
+)
+
+// simEpoch is where simulated time starts, so every run sees the same times
+var simEpoch = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// simClock is a Clock that only moves when the simulation advances it.
+// Timers fire in deadline order, ties broken by creation order.
+type simClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    int64
+	timers []*simTimer
+}
+
+type simTimer struct {
+	clock  *simClock
+	when   time.Time
+	seq    int64
+	period time.Duration // non-zero for tickers
+	fn     func()        // set for AfterFunc
+	ch     chan time.Time
+}
+
+func newSimClock() *simClock {
+	return &simClock{now: simEpoch}
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *simClock) After(d time.Duration) <-chan time.Time {
+	return c.schedule(d, 0, nil).ch
+}
+
+func (c *simClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.schedule(d, 0, f)
+}
+
+func (c *simClock) NewTicker(d time.Duration) Ticker {
+	return simTicker{c.schedule(d, d, nil)}
+}
+
+func (c *simClock) schedule(d, period time.Duration, f func()) *simTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &simTimer{clock: c, when: c.now.Add(d), seq: c.seq, period: period, fn: f, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Stop removes the timer, reporting whether it was still pending
+func (t *simTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type simTicker struct {
+	*simTimer
+}
+
+func (t simTicker) C() <-chan time.Time { return t.ch }
+func (t simTicker) Stop()               { t.simTimer.Stop() }
+
+// Advance moves the clock forward by d, firing every timer that falls due
+func (c *simClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		var next *simTimer
+		for _, t := range c.timers {
+			if !t.when.After(target) && (next == nil || t.when.Before(next.when) || (t.when.Equal(next.when) && t.seq < next.seq)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			for i, t := range c.timers {
+				if t == next {
+					c.timers = append(c.timers[:i], c.timers[i+1:]...)
+					break
+				}
+			}
+		}
+		if next.fn != nil {
+			go next.fn()
+		} else {
+			// Like time.Ticker, a slow receiver misses ticks
+			select {
+			case next.ch <- c.now:
+			default:
+			}
+		}
+	}
+	c.now = target
+}
+
+func (c *simClock) pendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// simMessage is a request, or the reply to one, waiting in the network
+type simMessage struct {
+	from  *InmemTransport // transport that sent the request
+	to    string
+	kind  string
+	reply bool
+	data  []byte
+	serve func(handler RPCHandler, req []byte) (interface{}, error)
+	done  chan simResult
+}
+
+type simResult struct {
+	data []byte
+	err  error
+}
+
+// key orders messages by content alone, so the order goroutines happened to
+// send them in does not influence the schedule
+func (m *simMessage) key() string {
+	return fmt.Sprintf("%s>%s|%s|%t|%s", m.from.addr, m.to, m.kind, m.reply, m.data)
+}
+
+func (m *simMessage) String() string {
+	if m.reply {
+		return fmt.Sprintf("%s reply %s->%s", m.kind, m.to, m.from.addr)
+	}
+	return fmt.Sprintf("%s %s->%s", m.kind, m.from.addr, m.to)
+}
+
+// simNetwork holds every message until the simulation decides to deliver
+// or drop it. Senders block in the meantime, as they would on a slow link.
+type simNetwork struct {
+	mu       sync.Mutex
+	live     map[string]*InmemTransport
+	handlers map[string]RPCHandler
+	groups   map[string]int
+	pending  []*simMessage
+	inflight int
+}
+
+func newSimNetwork() *simNetwork {
+	return &simNetwork{
+		live:     make(map[string]*InmemTransport),
+		handlers: make(map[string]RPCHandler),
+		groups:   make(map[string]int),
+	}
+}
+
+func (n *simNetwork) transport(addr string) *InmemTransport {
+	return &InmemTransport{addr: addr, network: n}
+}
+
+func (n *simNetwork) register(t *InmemTransport, handler RPCHandler) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.live[t.addr]; ok {
+		return fmt.Errorf("sim: address %s already in use", t.addr)
+	}
+	n.live[t.addr] = t
+	n.handlers[t.addr] = handler
+	return nil
+}
+
+// unregister takes a crashed node off the network. Its outstanding calls
+// fail, and nothing it sends from now on is delivered.
+func (n *simNetwork) unregister(t *InmemTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.live[t.addr] != t {
+		return
+	}
+	delete(n.live, t.addr)
+	delete(n.handlers, t.addr)
+
+	kept := n.pending[:0]
+	for _, m := range n.pending {
+		if m.from == t {
+			m.done <- simResult{err: ErrUnreachable}
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	n.pending = kept
+}
+
+func (n *simNetwork) call(from *InmemTransport, to string, args, reply interface{}, serve func(handler RPCHandler, req []byte) (interface{}, error)) error {
+	req, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	m := &simMessage{
+		from:  from,
+		to:    to,
+		kind:  strings.TrimSuffix(strings.TrimPrefix(fmt.Sprintf("%T", args), "*main."), "Args"),
+		data:  req,
+		serve: serve,
+		done:  make(chan simResult, 1),
+	}
+
+	n.mu.Lock()
+	if n.live[from.addr] != from {
+		n.mu.Unlock()
+		return ErrUnreachable
+	}
+	n.pending = append(n.pending, m)
+	n.mu.Unlock()
+
+	res := <-m.done
+	if res.err != nil {
+		return res.err
+	}
+	return json.Unmarshal(res.data, reply)
+}
+
+// messages returns the pending messages in canonical order
+func (n *simNetwork) messages() []*simMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	msgs := append([]*simMessage(nil), n.pending...)
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].key() < msgs[j].key() })
+	return msgs
+}
+
+// take removes m from the pending queue
+func (n *simNetwork) take(m *simMessage) bool {
+	for i, other := range n.pending {
+		if other == m {
+			n.pending = append(n.pending[:i], n.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// deliver hands a request to its target, or a reply back to its sender.
+// Requests across a partition or to a stopped node fail.
+func (n *simNetwork) deliver(m *simMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.take(m) {
+		return
+	}
+	if n.groups[m.from.addr] != n.groups[m.to] {
+		m.done <- simResult{err: ErrUnreachable}
+		return
+	}
+	if m.reply {
+		m.done <- simResult{data: m.data}
+		return
+	}
+	handler, ok := n.handlers[m.to]
+	if !ok {
+		m.done <- simResult{err: ErrUnreachable}
+		return
+	}
+
+	n.inflight++
+	go func() {
+		resp, err := m.serve(handler, m.data)
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(resp)
+		}
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.inflight--
+		if err != nil {
+			m.done <- simResult{err: err}
+			return
+		}
+		// The reply is queued like any other message
+		m.reply, m.data = true, data
+		n.pending = append(n.pending, m)
+	}()
+}
+
+// drop loses a message
+func (n *simNetwork) drop(m *simMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.take(m) {
+		m.done <- simResult{err: ErrDropped}
+	}
+}
+
+func (n *simNetwork) partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i + 1
+		}
+	}
+}
+
+func (n *simNetwork) stats() (pending, inflight int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.pending), n.inflight
+}
+
+// Node life cycle in the simulation
+const (
+	simUp        = "up"
+	simCrashed   = "crashed"   // stopped with its disk intact
+	simLost      = "lost"      // stopped with its disk wiped, waiting to be removed
+	simRemoved   = "removed"   // removed from the configuration, ready to rejoin
+	simRejoining = "rejoining" // running with an empty disk, joining again
+)
+
+type simNode struct {
+	raft *RaftNode
+	db   *DBEngine
+}
+
+// simulation drives a cluster on a simClock and simNetwork. Every decision,
+// which message to deliver, when time passes, which fault to inject, comes
+// from one seeded source, so a seed replays the same run.
+type simulation struct {
+	t       *testing.T
+	seed    int64
+	rand    *rand.Rand
+	clock   *simClock
+	network *simNetwork
+	ids     []string
+	dirs    map[string]string
+	step    int
+	trace   []string
+	starts  int64
+
+	mu      sync.Mutex
+	nodes   map[string]*simNode
+	status  map[string]string
+	clients int
+	writes  int
+	acked   map[string]string // key -> value of every acknowledged write
+
+	leaders   map[int64]string   // term -> leader observed in it
+	committed map[int64]LogEntry // index -> entry observed committed
+}
+
+func newSimulation(t *testing.T, seed int64) *simulation {
+	s := &simulation{
+		t:         t,
+		seed:      seed,
+		rand:      rand.New(rand.NewSource(seed)),
+		clock:     newSimClock(),
+		network:   newSimNetwork(),
+		dirs:      make(map[string]string),
+		nodes:     make(map[string]*simNode),
+		status:    make(map[string]string),
+		acked:     make(map[string]string),
+		leaders:   make(map[int64]string),
+		committed: make(map[int64]LogEntry),
+	}
+	members := make(map[string]string)
+	for i := 1; i <= simNodes; i++ {
+		id := fmt.Sprintf("n%d", i)
+		s.ids = append(s.ids, id)
+		members[id] = id
+	}
+	for _, id := range s.ids {
+		s.dirs[id] = t.TempDir()
+		s.start(id, members)
+	}
+	t.Cleanup(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for id := range s.nodes {
+			s.stop(id)
+		}
+	})
+	return s
+}
+
+// start runs a node on its data directory. Callers must hold s.mu unless
+// the simulation has not started yet.
+func (s *simulation) start(id string, members map[string]string) {
+	db, err := newDBEngine(s.dirs[id], DefaultConfig().Database, s.clock)
+	if err != nil {
+		s.fail("NewDBEngine(%s): %v", id, err)
+	}
+	cfg := RaftConfig{ElectionTimeoutMS: 150, HeartbeatIntervalMS: 30, SnapshotThreshold: 20}
+	s.starts++
+	node, err := newRaftNode(id, s.network.transport(id), "", s.dirs[id], cfg, members, db, NewCRDTStore(), s.clock, s.seed*1000+s.starts)
+	if err != nil {
+		s.fail("NewRaftNode(%s): %v", id, err)
+	}
+	s.nodes[id] = &simNode{raft: node, db: db}
+	s.status[id] = simUp
+}
+
+// stop crashes a node. Callers must hold s.mu.
+func (s *simulation) stop(id string) {
+	n := s.nodes[id]
+	n.raft.Shutdown()
+	// Let an apply in progress finish before the engine goes away
+	n.raft.applyMu.Lock()
+	n.db.Close()
+	n.raft.applyMu.Unlock()
+	delete(s.nodes, id)
+}
+
+func (s *simulation) fail(format string, args ...interface{}) {
+	s.t.Helper()
+	start := len(s.trace) - 40
+	if start < 0 {
+		start = 0
+	}
+	s.t.Fatalf("%s\nseed %d failed at step %d; replay with: go test -run 'TestSimulation$' -sim.seed=%d -sim.steps=%d -v\nlast actions:\n  %s",
+		fmt.Sprintf(format, args...), s.seed, s.step, s.seed, *simSteps, strings.Join(s.trace[start:], "\n  "))
+}
+
+func (s *simulation) record(format string, args ...interface{}) {
+	s.trace = append(s.trace, fmt.Sprintf("%d: ", s.step)+fmt.Sprintf(format, args...))
+}
+
+// settle waits until the goroutines woken by the last action have done
+// their work: nothing about the cluster changes for a few polls in a row
+func (s *simulation) settle() {
+	last := ""
+	for stable := 0; stable < settleRounds; {
+		time.Sleep(settlePoll)
+		if fp := s.fingerprint(); fp == last {
+			stable++
+		} else {
+			last, stable = fp, 0
+		}
+	}
+}
+
+func (s *simulation) fingerprint() string {
+	pending, inflight := s.network.stats()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d/%d/%d/%d", pending, inflight, s.clock.pendingTimers(), runtime.NumGoroutine())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(&b, "/%d/%d", s.clients, len(s.acked))
+	for _, id := range s.ids {
+		n, ok := s.nodes[id]
+		if !ok {
+			continue
+		}
+		r := n.raft
+		r.mu.RLock()
+		last, _ := r.lastLogIndexTerm()
+		fmt.Fprintf(&b, "|%s:%d/%d/%s/%d/%d/%d", id, r.state, r.currentTerm, r.votedFor, last, r.commitIndex, r.lastApplied)
+		r.mu.RUnlock()
+	}
+	return b.String()
+}
+
+// check verifies the safety properties that must hold at every step: one
+// leader per term, and committed entries never change
+func (s *simulation) check() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.ids {
+		n, ok := s.nodes[id]
+		if !ok {
+			continue
+		}
+		r := n.raft
+		r.mu.RLock()
+		if r.state == Leader {
+			if other, ok := s.leaders[r.currentTerm]; ok && other != id {
+				r.mu.RUnlock()
+				s.fail("two leaders in term %d: %s and %s", r.currentTerm, other, id)
+			}
+			s.leaders[r.currentTerm] = id
+		}
+		for i := r.snapshotIndex + 1; i <= r.commitIndex; i++ {
+			entry, ok := r.entryAt(i)
+			if !ok {
+				break
+			}
+			if prev, ok := s.committed[i]; ok && (prev.Term != entry.Term || prev.Type != entry.Type || string(prev.Command) != string(entry.Command)) {
+				r.mu.RUnlock()
+				s.fail("%s committed a different entry at index %d: term %d, want term %d", id, i, entry.Term, prev.Term)
+			}
+			s.committed[i] = entry
+		}
+		r.mu.RUnlock()
+	}
+}
+
+// leader returns a node that believes it leads, preferring the highest term.
+// Callers must hold s.mu.
+func (s *simulation) leader() *RaftNode {
+	var leader *RaftNode
+	var leaderTerm int64
+	for _, id := range s.ids {
+		n, ok := s.nodes[id]
+		if !ok {
+			continue
+		}
+		if state, term := n.raft.GetState(); state == "leader" && term > leaderTerm {
+			leader, leaderTerm = n.raft, term
+		}
+	}
+	return leader
+}
+
+// allUp reports whether every node runs normally. Callers must hold s.mu.
+func (s *simulation) allUp() bool {
+	for _, id := range s.ids {
+		if s.status[id] != simUp {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *simulation) pick(ids []string) string {
+	return ids[s.rand.Intn(len(ids))]
+}
+
+// nodesIn returns the nodes in status, in a stable order. Callers must hold
+// s.mu.
+func (s *simulation) nodesIn(status string) []string {
+	var ids []string
+	for _, id := range s.ids {
+		if s.status[id] == status {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+type simAction struct {
+	weight int
+	run    func()
+}
+
+// act picks one action at random among those possible right now
+func (s *simulation) act() {
+	msgs := s.network.messages()
+	var actions []simAction
+	if len(msgs) > 0 {
+		actions = append(actions,
+			simAction{60, func() {
+				m := msgs[s.rand.Intn(len(msgs))]
+				s.record("deliver %s", m)
+				s.network.deliver(m)
+			}},
+			simAction{3, func() {
+				m := msgs[s.rand.Intn(len(msgs))]
+				s.record("drop %s", m)
+				s.network.drop(m)
+			}},
+		)
+	}
+	actions = append(actions,
+		simAction{25, func() {
+			s.record("advance %s", tickInterval)
+			s.clock.Advance(tickInterval)
+		}},
+		simAction{6, s.write},
+		simAction{1, s.transfer},
+		simAction{2, func() {
+			ids := append([]string(nil), s.ids...)
+			s.rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+			cut := 1 + s.rand.Intn(len(ids)-1)
+			s.record("partition %v | %v", ids[:cut], ids[cut:])
+			s.network.partition(ids[:cut], ids[cut:])
+		}},
+		simAction{3, func() {
+			s.record("heal")
+			s.network.partition()
+		}},
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Faults that stop nodes are injected one at a time, so a majority can
+	// always make progress once the network heals
+	if s.allUp() {
+		actions = append(actions,
+			simAction{1, func() {
+				id := s.pick(s.ids)
+				s.record("crash %s", id)
+				s.stop(id)
+				s.status[id] = simCrashed
+			}},
+			simAction{1, func() {
+				id := s.pick(s.ids)
+				s.record("disk loss on %s", id)
+				s.stop(id)
+				if err := os.RemoveAll(s.dirs[id]); err != nil {
+					s.fail("wipe %s: %v", id, err)
+				}
+				s.status[id] = simLost
+				s.clients++
+				go s.replace(id)
+			}},
+		)
+	}
+	if crashed := s.nodesIn(simCrashed); len(crashed) > 0 {
+		actions = append(actions, simAction{4, func() {
+			id := s.pick(crashed)
+			s.record("restart %s", id)
+			s.restart(id)
+		}})
+	}
+	if removed := s.nodesIn(simRemoved); len(removed) > 0 {
+		actions = append(actions, simAction{4, func() { s.rejoin(removed[0]) }})
+	}
+
+	total := 0
+	for _, a := range actions {
+		total += a.weight
+	}
+	n := s.rand.Intn(total)
+	for _, a := range actions {
+		if n < a.weight {
+			a.run()
+			return
+		}
+		n -= a.weight
+	}
+}
+
+// write submits a client write to the node that believes it leads. Callers
+// must hold s.mu.
+func (s *simulation) write() {
+	leader := s.leader()
+	if leader == nil {
+		s.record("write skipped: no leader")
+		return
+	}
+	s.writes++
+	key, value := fmt.Sprintf("k%d", s.writes), fmt.Sprintf("v%d", s.writes)
+	s.record("write %s=%s via %s", key, value, leader.nodeID)
+	cmd := Command{
+		Type:       CmdInsert,
+		Key:        key,
+		Value:      value,
+		ValidStart: simEpoch.Add(-time.Hour),
+		ValidEnd:   time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	s.clients++
+	go func() {
+		err := leader.Apply(cmd)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.clients--
+		if err == nil {
+			s.acked[key] = value
+		}
+	}()
+}
+
+// transfer asks the node that believes it leads to hand over to another
+// voter. Callers must hold s.mu.
+func (s *simulation) transfer() {
+	leader := s.leader()
+	if leader == nil {
+		s.record("transfer skipped: no leader")
+		return
+	}
+	to := s.pick(s.ids)
+	s.record("transfer leadership from %s to %s", leader.nodeID, to)
+	s.clients++
+	go func() {
+		leader.TransferLeadership(to)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.clients--
+	}()
+}
+
+// restart brings a crashed node back on its old disk. Callers must hold s.mu.
+func (s *simulation) restart(id string) {
+	members := make(map[string]string)
+	for _, other := range s.ids {
+		members[other] = other
+	}
+	s.start(id, members)
+}
+
+// replace is the operator's side of a disk loss: a node that forgot its
+// votes must not rejoin under its old identity before it has been removed
+// from the configuration
+func (s *simulation) replace(id string) {
+	for {
+		s.mu.Lock()
+		leader := s.leader()
+		s.mu.Unlock()
+		if leader != nil {
+			err := leader.RemoveNode(id)
+			if err == nil || errors.Is(err, ErrInvalidConfigChange) {
+				break
+			}
+		}
+		<-s.clock.After(time.Second)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients--
+	s.status[id] = simRemoved
+}
+
+// rejoin starts a removed node on an empty disk and has it join the
+// cluster again. Callers must hold s.mu.
+func (s *simulation) rejoin(id string) {
+	s.record("rejoin %s", id)
+	s.start(id, map[string]string{})
+	s.status[id] = simRejoining
+
+	target := s.ids[0]
+	if target == id {
+		target = s.ids[1]
+	}
+	node := s.nodes[id].raft
+	s.clients++
+	go func() {
+		err := node.Join(id, id, target)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.clients--
+		if err == nil {
+			s.status[id] = simUp
+		}
+	}()
+}
+
+// finish heals every fault and runs the cluster until it converges, then
+// checks that all replicas agree and kept every acknowledged write
+func (s *simulation) finish() {
+	s.step++
+	s.record("heal and restart everything")
+	s.network.partition()
+	s.mu.Lock()
+	for _, id := range s.nodesIn(simCrashed) {
+		s.restart(id)
+	}
+	s.mu.Unlock()
+
+	for round := 0; !s.converged(); round++ {
+		if round == finishRounds {
+			s.fail("cluster did not converge after healing: %s", s.fingerprint())
+		}
+		s.mu.Lock()
+		for _, id := range s.nodesIn(simRemoved) {
+			s.rejoin(id)
+		}
+		s.mu.Unlock()
+
+		if msgs := s.network.messages(); len(msgs) > 0 {
+			s.network.deliver(msgs[s.rand.Intn(len(msgs))])
+		} else {
+			s.clock.Advance(tickInterval)
+		}
+		s.settle()
+		s.check()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var want map[string][]TemporalRecord
+	for _, id := range s.ids {
+		db := s.nodes[id].db
+		data, _ := db.SnapshotData()
+		if want == nil {
+			want = data
+		} else if normalize(data) != normalize(want) {
+			s.fail("%s diverged from %s", id, s.ids[0])
+		}
+		for key, value := range s.acked {
+			if got, found := db.QueryCurrent(key); !found || got != value {
+				s.fail("%s lost acknowledged write %s=%s (found %v, %v)", id, key, value, got, found)
+			}
+		}
+	}
+}
+
+// normalize round-trips data through JSON so replicas that loaded records
+// from disk compare equal to ones that applied them in memory
+func normalize(data map[string][]TemporalRecord) string {
+	b, _ := json.Marshal(data)
+	return string(b)
+}
+
+// converged reports whether every node runs, one leader leads them all and
+// every node has applied its whole log with no client still waiting
+func (s *simulation) converged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.allUp() || s.clients > 0 {
+		return false
+	}
+	leader := s.leader()
+	if leader == nil {
+		return false
+	}
+	leader.mu.RLock()
+	want, _ := leader.lastLogIndexTerm()
+	leaderTerm := leader.currentTerm
+	committed := leader.commitIndex == want
+	leader.mu.RUnlock()
+	if !committed {
+		return false
+	}
+	for _, id := range s.ids {
+		r := s.nodes[id].raft
+		r.mu.RLock()
+		last, _ := r.lastLogIndexTerm()
+		ok := r.currentTerm == leaderTerm && last == want && r.lastApplied == want
+		r.mu.RUnlock()
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// run executes the simulation and returns its trace
+func (s *simulation) run(steps int) []string {
+	for s.step = 1; s.step <= steps; s.step++ {
+		s.act()
+		s.settle()
+		s.check()
+	}
+	s.finish()
+	return s.trace
+}
+
+// quietLogs silences the cluster's logging for the rest of the test
+func quietLogs(t *testing.T) {
+	if testing.Verbose() && *simSeed != 0 {
+		return
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// TestSimulation runs the cluster under randomly scheduled messages, clock
+// ticks, client writes, crashes, restarts, partitions and disk loss. A
+// failing seed is printed together with the command that replays it.
+func TestSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulation skipped in short mode")
+	}
+	quietLogs(t)
+
+	seeds := []int64{*simSeed}
+	if *simSeed == 0 {
+		seeds = seeds[:0]
+		for i := 1; i <= *simSeeds; i++ {
+			seeds = append(seeds, int64(i))
+		}
+	}
+	for _, seed := range seeds {
+		seed := seed
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			s := newSimulation(t, seed)
+			trace := s.run(*simSteps)
+			t.Logf("%d actions, %d writes, %d acknowledged", len(trace), s.writes, len(s.acked))
+		})
+	}
+}
+
+// TestSimulationReplaysSeed checks that a seed schedules the same run twice
+func TestSimulationReplaysSeed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulation skipped in short mode")
+	}
+	quietLogs(t)
+
+	first := newSimulation(t, 42).run(100)
+	second := newSimulation(t, 42).run(100)
+	for i := 0; i < len(first) && i < len(second); i++ {
+		if first[i] != second[i] {
+			t.Fatalf("runs of seed 42 diverged at action %d:\n  %s\n  %s", i, first[i], second[i])
+		}
+	}
+	if len(second) != len(first) {
+		t.Fatalf("second run of seed 42 took %d actions, first took %d", len(second), len(first))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotMagic      = "CHRONOSN"
+	snapshotVersion    = 1
+	snapshotHeaderSize = 24 // magic (8) + version (4) + length (8) + crc (4)
+)
+
+// ErrSnapshotCorrupt is returned when a snapshot file is truncated or fails its checksum
+var ErrSnapshotCorrupt = errors.New("snapshot corrupt")
+
+// writeSnapshotFile atomically replaces path with a versioned, checksummed
+// copy of payload. The data goes to a temp file that is fsynced and renamed
+// into place. With keepPrevious the old file is kept as path.prev so a
+// reader can fall back to it.
+func writeSnapshotFile(path string, payload []byte, keepPrevious bool) error {
+	header := make([]byte, snapshotHeaderSize)
+	copy(header[0:8], snapshotMagic)
+	binary.BigEndian.PutUint32(header[8:12], snapshotVersion)
+	binary.BigEndian.PutUint64(header[12:20], uint64(len(payload)))
+	binary.BigEndian.PutUint32(header[20:24], crc32.Checksum(payload, walCRCTable))
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	if _, err := file.Write(append(header, payload...)); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to sync snapshot file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to close snapshot file: %w", err)
+	}
+
+	if keepPrevious {
+		if err := os.Rename(path, path+".prev"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to keep previous snapshot: %w", err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to install snapshot file: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readSnapshotFile returns the verified payload of a snapshot file. Files
+// written before the header existed are plain JSON and are returned as-is
+// with version 0.
+func readSnapshotFile(path string) ([]byte, int, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !bytes.HasPrefix(raw, []byte(snapshotMagic)) {
+		trimmed := bytes.TrimSpace(raw)
+		if len(trimmed) > 0 && trimmed[0] == '{' {
+			return raw, 0, nil
+		}
+		if len(raw) < len(snapshotMagic) && bytes.HasPrefix([]byte(snapshotMagic), raw) {
+			return nil, 0, fmt.Errorf("%w: %s: truncated header", ErrSnapshotCorrupt, path)
+		}
+		return nil, 0, fmt.Errorf("%w: %s: unrecognized file format", ErrSnapshotCorrupt, path)
+	}
+	if len(raw) < snapshotHeaderSize {
+		return nil, 0, fmt.Errorf("%w: %s: truncated header", ErrSnapshotCorrupt, path)
+	}
+
+	version := int(binary.BigEndian.Uint32(raw[8:12]))
+	if version != snapshotVersion {
+		return nil, version, fmt.Errorf("%s: unsupported snapshot version %d", path, version)
+	}
+
+	length := binary.BigEndian.Uint64(raw[12:20])
+	payload := raw[snapshotHeaderSize:]
+	if uint64(len(payload)) != length {
+		return nil, version, fmt.Errorf("%w: %s: expected %d bytes of data, found %d",
+			ErrSnapshotCorrupt, path, length, len(payload))
+	}
+	if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(raw[20:24]) {
+		return nil, version, fmt.Errorf("%w: %s: checksum mismatch", ErrSnapshotCorrupt, path)
+	}
+	return payload, version, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSnapshotFileDetectsCorruption(t *testing.T) {
+	payload := []byte(`{"checkpoint_lsn":7,"data":{}}`)
+	for _, tt := range []struct {
+		name    string
+		corrupt func(raw []byte) []byte
+	}{
+		{"checksum mismatch", func(raw []byte) []byte {
+			raw[len(raw)-3] ^= 0x01
+			return raw
+		}},
+		{"truncated payload", func(raw []byte) []byte { return raw[:len(raw)-5] }},
+		{"truncated header", func(raw []byte) []byte { return raw[:snapshotHeaderSize-4] }},
+		{"truncated magic", func(raw []byte) []byte { return raw[:3] }},
+		{"garbage", func(raw []byte) []byte { return []byte("not a snapshot") }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snap")
+			if err := writeSnapshotFile(path, payload, false); err != nil {
+				t.Fatalf("writeSnapshotFile: %v", err)
+			}
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if err := os.WriteFile(path, tt.corrupt(raw), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			if _, _, err := readSnapshotFile(path); !errors.Is(err, ErrSnapshotCorrupt) {
+				t.Fatalf("readSnapshotFile = %v, want ErrSnapshotCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestWriteSnapshotFileKeepsPrevious(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snap")
+	for _, payload := range []string{`{"n":1}`, `{"n":2}`} {
+		if err := writeSnapshotFile(path, []byte(payload), true); err != nil {
+			t.Fatalf("writeSnapshotFile: %v", err)
+		}
+	}
+
+	for file, want := range map[string]string{path: `{"n":2}`, path + ".prev": `{"n":1}`} {
+		got, version, err := readSnapshotFile(file)
+		if err != nil || version != snapshotVersion || string(got) != want {
+			t.Errorf("%s holds %s (version %d, %v), want %s", filepath.Base(file), got, version, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+}
+
+func TestReadSnapshotFileAcceptsPlainJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chrono_db.json")
+	if err := os.WriteFile(path, []byte(`{"k":[]}`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	payload, version, err := readSnapshotFile(path)
+	if err != nil || version != 0 || string(payload) != `{"k":[]}` {
+		t.Fatalf("readSnapshotFile = %s, version %d, %v; want the file as-is at version 0", payload, version, err)
+	}
+}
+
+func TestLoadFallsBackToPreviousCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, DefaultConfig().Database)
+	mustInsert(t, db, "x", "one") // LSN 1
+	mustCheckpoint(t, db)
+	mustInsert(t, db, "y", "two") // LSN 2
+	mustCheckpoint(t, db)
+	mustInsert(t, db, "z", "three") // LSN 3, only in the WAL
+	crash(db)
+
+	dataFile := filepath.Join(dir, "chrono_db.json")
+	flipLastByte := func(path string) {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		raw[len(raw)-1] ^= 0xff
+		if err := os.WriteFile(path, raw, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	flipLastByte(dataFile)
+
+	db = openDB(t, dir, DefaultConfig().Database)
+	if db.checkpointLSN != 1 {
+		t.Errorf("loaded checkpoint at LSN %d, want the previous one at 1", db.checkpointLSN)
+	}
+	assertValues(t, db, map[string]interface{}{"x": "one", "y": "two", "z": "three"})
+	crash(db)
+
+	// With both checkpoints unreadable there is nothing safe to start from
+	flipLastByte(dataFile + ".prev")
+	if _, err := NewDBEngine(dir, DefaultConfig().Database); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("NewDBEngine with both checkpoints corrupt = %v, want ErrSnapshotCorrupt", err)
+	}
+}
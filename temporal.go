@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrEmptyPeriod is returned for a write whose valid time does not end
+	// after it starts
+	ErrEmptyPeriod = errors.New("valid-time period is empty")
+	// ErrUnknownRelation is returned for an interval relation that is not
+	// one of Allen's
+	ErrUnknownRelation = errors.New("unknown interval relation")
+)
+
+// endOfTime is the valid-time end of facts written without one
+var endOfTime = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// Period is a closed-open interval of time [Start, End): it includes its
+// start instant and excludes its end, so a period that ends where another
+// starts shares no instant with it. Valid time and transaction time are both
+// periods of this kind.
+type Period struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Contains reports whether t lies in the period
+func (p Period) Contains(t time.Time) bool {
+	return !t.Before(p.Start) && t.Before(p.End)
+}
+
+// Overlaps reports whether the periods share at least one instant
+func (p Period) Overlaps(q Period) bool {
+	return p.Start.Before(q.End) && q.Start.Before(p.End)
+}
+
+// AllenRelation is one of the thirteen ways two non-empty periods can be
+// placed relative to each other (J. F. Allen, 1983). Exactly one holds for
+// any pair; it reads "p <relation> q".
+type AllenRelation string
+
+const (
+	AllenBefore       AllenRelation = "before"        // p ends before q starts, with a gap
+	AllenMeets        AllenRelation = "meets"         // p ends where q starts
+	AllenOverlaps     AllenRelation = "overlaps"      // p starts first and ends inside q
+	AllenStarts       AllenRelation = "starts"        // p starts with q and ends first
+	AllenDuring       AllenRelation = "during"        // p lies inside q, touching neither end
+	AllenFinishes     AllenRelation = "finishes"      // p ends with q and starts later
+	AllenEquals       AllenRelation = "equals"        // p and q are the same period
+	AllenAfter        AllenRelation = "after"         // inverse of before
+	AllenMetBy        AllenRelation = "met_by"        // inverse of meets
+	AllenOverlappedBy AllenRelation = "overlapped_by" // inverse of overlaps
+	AllenStartedBy    AllenRelation = "started_by"    // inverse of starts
+	AllenContains     AllenRelation = "contains"      // inverse of during
+	AllenFinishedBy   AllenRelation = "finished_by"   // inverse of finishes
+
+	// AllenIntersects is not one of Allen's relations but the union of the
+	// nine in which the periods share an instant
+	AllenIntersects AllenRelation = "intersects"
+)
+
+// ParseAllenRelation parses a relation name; empty means AllenIntersects
+func ParseAllenRelation(s string) (AllenRelation, error) {
+	switch rel := AllenRelation(s); rel {
+	case "":
+		return AllenIntersects, nil
+	case AllenBefore, AllenMeets, AllenOverlaps, AllenStarts, AllenDuring, AllenFinishes, AllenEquals,
+		AllenAfter, AllenMetBy, AllenOverlappedBy, AllenStartedBy, AllenContains, AllenFinishedBy, AllenIntersects:
+		return rel, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownRelation, s)
+}
+
+// Relation returns the Allen relation that holds between p and q
+func (p Period) Relation(q Period) AllenRelation {
+	switch {
+	case p.End.Before(q.Start):
+		return AllenBefore
+	case p.End.Equal(q.Start):
+		return AllenMeets
+	case q.End.Before(p.Start):
+		return AllenAfter
+	case q.End.Equal(p.Start):
+		return AllenMetBy
+	}
+
+	// The periods share an instant
+	startCmp, endCmp := compareTimes(p.Start, q.Start), compareTimes(p.End, q.End)
+	switch {
+	case startCmp == 0 && endCmp == 0:
+		return AllenEquals
+	case startCmp == 0 && endCmp < 0:
+		return AllenStarts
+	case startCmp == 0:
+		return AllenStartedBy
+	case endCmp == 0 && startCmp > 0:
+		return AllenFinishes
+	case endCmp == 0:
+		return AllenFinishedBy
+	case startCmp > 0 && endCmp < 0:
+		return AllenDuring
+	case startCmp < 0 && endCmp > 0:
+		return AllenContains
+	case startCmp < 0:
+		return AllenOverlaps
+	}
+	return AllenOverlappedBy
+}
+
+// Holds reports whether p stands in relation rel to q
+func (p Period) Holds(rel AllenRelation, q Period) bool {
+	if rel == AllenIntersects {
+		return p.Overlaps(q)
+	}
+	return p.Relation(q) == rel
+}
+
+// compareTimes returns -1, 0 or 1 as a is before, equal to or after b
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// ValidPeriod returns the period during which the record's fact held
+func (rec TemporalRecord) ValidPeriod() Period {
+	return Period{Start: rec.ValidTimeStart, End: rec.ValidTimeEnd}
+}
+
+// currentAt reports whether the record was part of the database's knowledge
+// at transaction time asOf
+func (rec TemporalRecord) currentAt(asOf time.Time) bool {
+	if rec.TransactionTime.After(asOf) {
+		return false
+	}
+	return rec.TransactionTimeEnd == nil || asOf.Before(*rec.TransactionTimeEnd)
+}
+
+// put stores a fact for its valid-time period [start, end) the way SQL:2011
+// UPDATE ... FOR PORTION OF does: every current record of the key that
+// overlaps the period is closed in transaction time, and the parts of it
+// outside the period are written back as new records alongside the fact.
+// The history keeps the superseded records, so queries as of an earlier
+// transaction time still see them. Callers must hold db.mu.
+func (db *DBEngine) put(fact TemporalRecord) {
+	records := db.data[fact.Key]
+	txTime := fact.TransactionTime
+	added := []TemporalRecord{fact}
+	for i := range records {
+		old := &records[i]
+		if old.TransactionTimeEnd != nil || !old.ValidPeriod().Overlaps(fact.ValidPeriod()) {
+			continue
+		}
+		end := txTime
+		old.TransactionTimeEnd = &end
+
+		// The remainders carry the old value under the new transaction time
+		remainder := *old
+		remainder.TransactionTime = txTime
+		remainder.TransactionTimeEnd = nil
+		if old.ValidTimeStart.Before(fact.ValidTimeStart) {
+			before := remainder
+			before.ValidTimeEnd = fact.ValidTimeStart
+			added = append(added, before)
+		}
+		if old.ValidTimeEnd.After(fact.ValidTimeEnd) {
+			after := remainder
+			after.ValidTimeStart = fact.ValidTimeEnd
+			added = append(added, after)
+		}
+	}
+	sort.SliceStable(added, func(i, j int) bool {
+		return added[i].ValidTimeStart.Before(added[j].ValidTimeStart)
+	})
+	db.data[fact.Key] = append(records, added...)
+	db.observeTxTime(txTime)
+}
+
+// QueryRange returns the records of key that were current as of asOf and
+// whose valid-time period stands in relation rel to period, ordered by the
+// start of their valid time. Tombstones are left out.
+func (db *DBEngine) QueryRange(key string, asOf time.Time, period Period, rel AllenRelation) []TemporalRecord {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	matches := []TemporalRecord{}
+	for _, rec := range db.data[key] {
+		if rec.Deleted || !rec.currentAt(asOf) {
+			continue
+		}
+		if rec.ValidPeriod().Holds(rel, period) {
+			matches = append(matches, rec)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].ValidTimeStart.Before(matches[j].ValidTimeStart)
+	})
+	return matches
+}
+
+// TimelineSegment is a stretch of valid time during which a key had one value
+type TimelineSegment struct {
+	Value      interface{} `json:"value"`
+	ValidStart time.Time   `json:"valid_start"`
+	ValidEnd   time.Time   `json:"valid_end"`
+}
+
+// QueryTimeline returns the values key had across the valid-time range
+// [from, to) as known at transaction time asOf, in order. Segments are
+// clipped to the range, adjacent segments with equal values are merged, and
+// stretches where the key had no value are left out.
+func (db *DBEngine) QueryTimeline(key string, asOf, from, to time.Time) []TimelineSegment {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	records := db.data[key]
+	rangePeriod := Period{Start: from, End: to}
+
+	// The value can only change where some current record starts or ends
+	bounds := []time.Time{from, to}
+	for _, rec := range records {
+		if !rec.currentAt(asOf) || !rec.ValidPeriod().Overlaps(rangePeriod) {
+			continue
+		}
+		for _, t := range []time.Time{rec.ValidTimeStart, rec.ValidTimeEnd} {
+			if rangePeriod.Contains(t) {
+				bounds = append(bounds, t)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].Before(bounds[j]) })
+
+	timeline := []TimelineSegment{}
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if !start.Before(end) {
+			continue
+		}
+		rec, found := recordAt(records, asOf, start)
+		if !found || rec.Deleted {
+			continue
+		}
+		if n := len(timeline); n > 0 {
+			last := &timeline[n-1]
+			if last.ValidEnd.Equal(start) && reflect.DeepEqual(last.Value, rec.Value) {
+				last.ValidEnd = end
+				continue
+			}
+		}
+		timeline = append(timeline, TimelineSegment{Value: rec.Value, ValidStart: start, ValidEnd: end})
+	}
+	return timeline
+}
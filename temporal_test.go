@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func date(month time.Month, day int) time.Time {
+	return time.Date(2024, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func newTestDB(t *testing.T) *DBEngine {
+	t.Helper()
+	db, err := NewDBEngine(t.TempDir(), DefaultConfig().Database)
+	if err != nil {
+		t.Fatalf("NewDBEngine: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestCorrectionSplitsOverlappingPeriod(t *testing.T) {
+	db := newTestDB(t)
+	t1 := date(time.January, 10)
+	t2 := date(time.July, 10)
+
+	if err := db.InsertAt("price", 100, date(time.January, 1), date(time.December, 31), t1); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+	// Learned in July that the price was 120 from March to June
+	if err := db.InsertAt("price", 120, date(time.March, 1), date(time.June, 1), t2); err != nil {
+		t.Fatalf("InsertAt correction: %v", err)
+	}
+
+	history := db.GetHistory("price")
+	if len(history) != 4 {
+		t.Fatalf("history has %d records, want the original and three slices: %+v", len(history), history)
+	}
+	if end := history[0].TransactionTimeEnd; end == nil || !end.Equal(t2) {
+		t.Errorf("original record closed at %v, want %v", end, t2)
+	}
+	want := []struct {
+		value      interface{}
+		start, end time.Time
+	}{
+		{100, date(time.January, 1), date(time.March, 1)},
+		{120, date(time.March, 1), date(time.June, 1)},
+		{100, date(time.June, 1), date(time.December, 31)},
+	}
+	for i, w := range want {
+		rec := history[i+1]
+		if rec.Value != w.value || !rec.ValidTimeStart.Equal(w.start) || !rec.ValidTimeEnd.Equal(w.end) ||
+			!rec.TransactionTime.Equal(t2) || rec.TransactionTimeEnd != nil {
+			t.Errorf("slice %d = %v over [%v, %v) recorded %v-%v, want %v over [%v, %v) recorded at %v",
+				i, rec.Value, rec.ValidTimeStart, rec.ValidTimeEnd, rec.TransactionTime, rec.TransactionTimeEnd,
+				w.value, w.start, w.end, t2)
+		}
+	}
+
+	queries := []struct {
+		asOf, valid time.Time
+		want        interface{}
+	}{
+		{t2, date(time.April, 15), 120},
+		{t2, date(time.February, 15), 100},
+		{t2, date(time.August, 15), 100},
+		// Before the correction was recorded the database still said 100
+		{t2.Add(-time.Hour), date(time.April, 15), 100},
+	}
+	for _, q := range queries {
+		if got, found := db.QueryTemporal("price", q.asOf, q.valid); !found || got != q.want {
+			t.Errorf("QueryTemporal(as of %v, valid %v) = %v, %v; want %v", q.asOf, q.valid, got, found, q.want)
+		}
+	}
+}
+
+func TestCorrectionSupersedesSeveralRecords(t *testing.T) {
+	db := newTestDB(t)
+	db.InsertAt("rate", "a", date(time.January, 1), date(time.March, 1), date(time.January, 1))
+	db.InsertAt("rate", "b", date(time.March, 1), date(time.May, 1), date(time.January, 2))
+	db.InsertAt("rate", "c", date(time.May, 1), date(time.July, 1), date(time.January, 3))
+
+	// A period that covers "b" whole and clips "a" and "c"
+	txTime := date(time.August, 1)
+	if err := db.InsertAt("rate", "x", date(time.February, 1), date(time.June, 1), txTime); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+
+	var current []TemporalRecord
+	for _, rec := range db.GetHistory("rate") {
+		if rec.currentAt(txTime) {
+			current = append(current, rec)
+		}
+	}
+	want := []struct {
+		value      string
+		start, end time.Time
+	}{
+		{"a", date(time.January, 1), date(time.February, 1)},
+		{"x", date(time.February, 1), date(time.June, 1)},
+		{"c", date(time.June, 1), date(time.July, 1)},
+	}
+	if len(current) != len(want) {
+		t.Fatalf("%d current records, want %d: %+v", len(current), len(want), current)
+	}
+	for i, w := range want {
+		rec := current[i]
+		if rec.Value != w.value || !rec.ValidTimeStart.Equal(w.start) || !rec.ValidTimeEnd.Equal(w.end) {
+			t.Errorf("current record %d = %v over [%v, %v), want %v over [%v, %v)",
+				i, rec.Value, rec.ValidTimeStart, rec.ValidTimeEnd, w.value, w.start, w.end)
+		}
+	}
+}
+
+func TestInsertRejectsEmptyPeriod(t *testing.T) {
+	db := newTestDB(t)
+	err := db.InsertAt("k", 1, date(time.March, 1), date(time.March, 1), date(time.March, 1))
+	if !errors.Is(err, ErrEmptyPeriod) {
+		t.Fatalf("InsertAt over an empty period = %v, want ErrEmptyPeriod", err)
+	}
+}
+
+func TestDeleteRetractsPeriod(t *testing.T) {
+	db := newTestDB(t)
+	t1 := date(time.January, 10)
+	t2 := date(time.July, 10)
+	db.InsertAt("account", "open", date(time.January, 1), date(time.December, 31), t1)
+
+	if err := db.DeleteAt("account", date(time.March, 1), date(time.June, 1), t2); err != nil {
+		t.Fatalf("DeleteAt: %v", err)
+	}
+
+	queries := []struct {
+		asOf, valid time.Time
+		found       bool
+	}{
+		{t2, date(time.April, 15), false},
+		{t2, date(time.February, 15), true},
+		{t2, date(time.August, 15), true},
+		// Before the retraction was recorded the value was still there
+		{t2.Add(-time.Hour), date(time.April, 15), true},
+	}
+	for _, q := range queries {
+		got, found := db.QueryTemporal("account", q.asOf, q.valid)
+		if found != q.found || (found && got != "open") {
+			t.Errorf("QueryTemporal(as of %v, valid %v) = %v, %v; want found %v", q.asOf, q.valid, got, found, q.found)
+		}
+	}
+
+	// The retraction is a version of its own in the history
+	var tombstones int
+	for _, rec := range db.GetHistory("account") {
+		if rec.Deleted {
+			tombstones++
+			if rec.Value != nil || !rec.TransactionTime.Equal(t2) || !rec.ValidTimeStart.Equal(date(time.March, 1)) {
+				t.Errorf("tombstone = %+v", rec)
+			}
+		}
+	}
+	if tombstones != 1 {
+		t.Errorf("history has %d tombstones, want 1", tombstones)
+	}
+
+	// Writing the period again brings the key back
+	if err := db.InsertAt("account", "reopened", date(time.April, 1), date(time.May, 1), date(time.August, 1)); err != nil {
+		t.Fatalf("InsertAt: %v", err)
+	}
+	if got, found := db.QueryTemporal("account", date(time.August, 1), date(time.April, 15)); !found || got != "reopened" {
+		t.Errorf("after reinsert got %v, %v; want reopened", got, found)
+	}
+	if _, found := db.QueryTemporal("account", date(time.August, 1), date(time.March, 15)); found {
+		t.Errorf("reinsert brought back the rest of the deleted period")
+	}
+}
+
+func TestQueryTemporalUsesClosedOpenPeriods(t *testing.T) {
+	db := newTestDB(t)
+	db.InsertAt("k", "march", date(time.March, 1), date(time.April, 1), date(time.January, 1))
+	db.InsertAt("k", "april", date(time.April, 1), date(time.May, 1), date(time.January, 2))
+
+	asOf := date(time.June, 1)
+	tests := []struct {
+		valid time.Time
+		want  interface{}
+	}{
+		{date(time.March, 1), "march"}, // a fact holds at its start instant
+		{date(time.April, 1).Add(-time.Nanosecond), "march"},
+		{date(time.April, 1), "april"}, // and not at its end
+		{date(time.May, 1), nil},
+	}
+	for _, tt := range tests {
+		got, found := db.QueryTemporal("k", asOf, tt.valid)
+		if tt.want == nil {
+			if found {
+				t.Errorf("QueryTemporal at %v = %v, want not found", tt.valid, got)
+			}
+			continue
+		}
+		if !found || got != tt.want {
+			t.Errorf("QueryTemporal at %v = %v, %v; want %v", tt.valid, got, found, tt.want)
+		}
+	}
+}
+
+func TestPeriodRelation(t *testing.T) {
+	q := Period{date(time.March, 1), date(time.June, 1)}
+	tests := []struct {
+		p    Period
+		want AllenRelation
+	}{
+		{Period{date(time.January, 1), date(time.February, 1)}, AllenBefore},
+		{Period{date(time.January, 1), date(time.March, 1)}, AllenMeets},
+		{Period{date(time.January, 1), date(time.April, 1)}, AllenOverlaps},
+		{Period{date(time.March, 1), date(time.April, 1)}, AllenStarts},
+		{Period{date(time.April, 1), date(time.May, 1)}, AllenDuring},
+		{Period{date(time.April, 1), date(time.June, 1)}, AllenFinishes},
+		{Period{date(time.March, 1), date(time.June, 1)}, AllenEquals},
+		{Period{date(time.July, 1), date(time.August, 1)}, AllenAfter},
+		{Period{date(time.June, 1), date(time.August, 1)}, AllenMetBy},
+		{Period{date(time.April, 1), date(time.August, 1)}, AllenOverlappedBy},
+		{Period{date(time.March, 1), date(time.August, 1)}, AllenStartedBy},
+		{Period{date(time.January, 1), date(time.August, 1)}, AllenContains},
+		{Period{date(time.January, 1), date(time.June, 1)}, AllenFinishedBy},
+	}
+	for _, tt := range tests {
+		if got := tt.p.Relation(q); got != tt.want {
+			t.Errorf("%v-%v relation to %v-%v = %s, want %s", tt.p.Start, tt.p.End, q.Start, q.End, got, tt.want)
+		}
+		// Periods that only meet share no instant
+		intersects := tt.want != AllenBefore && tt.want != AllenMeets && tt.want != AllenAfter && tt.want != AllenMetBy
+		if got := tt.p.Holds(AllenIntersects, q); got != intersects {
+			t.Errorf("%v-%v intersects %v-%v = %v, want %v", tt.p.Start, tt.p.End, q.Start, q.End, got, intersects)
+		}
+	}
+
+	if _, err := ParseAllenRelation("near"); !errors.Is(err, ErrUnknownRelation) {
+		t.Errorf("ParseAllenRelation(near) = %v, want ErrUnknownRelation", err)
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	db := newTestDB(t)
+	db.InsertAt("plan", "basic", date(time.January, 1), date(time.March, 1), date(time.January, 1))
+	db.InsertAt("plan", "pro", date(time.March, 1), date(time.May, 1), date(time.January, 1).Add(time.Second))
+	db.InsertAt("plan", "team", date(time.May, 1), date(time.September, 1), date(time.January, 1).Add(2*time.Second))
+	db.DeleteAt("plan", date(time.August, 1), date(time.September, 1), date(time.February, 1))
+
+	values := func(records []TemporalRecord) string {
+		var out []interface{}
+		for _, rec := range records {
+			out = append(out, rec.Value)
+		}
+		return fmt.Sprint(out)
+	}
+	asOf := date(time.December, 1)
+	q := Period{date(time.March, 1), date(time.June, 1)}
+	tests := []struct {
+		rel  AllenRelation
+		want string
+	}{
+		{AllenIntersects, "[pro team]"},
+		{AllenMeets, "[basic]"},
+		{AllenStarts, "[pro]"},
+		{AllenOverlappedBy, "[team]"},
+		{AllenDuring, "[]"},
+	}
+	for _, tt := range tests {
+		if got := values(db.QueryRange("plan", asOf, q, tt.rel)); got != tt.want {
+			t.Errorf("QueryRange(%s) = %s, want %s", tt.rel, got, tt.want)
+		}
+	}
+
+	// Before the delete was recorded "team" ran until September
+	if got := values(db.QueryRange("plan", date(time.January, 15), Period{date(time.August, 15), date(time.August, 20)}, AllenContains)); got != "[team]" {
+		t.Errorf("QueryRange as of before the delete = %s, want [team]", got)
+	}
+}
+
+func TestQueryTimeline(t *testing.T) {
+	db := newTestDB(t)
+	db.InsertAt("tier", "silver", date(time.January, 1), date(time.March, 1), date(time.January, 1))
+	db.InsertAt("tier", "gold", date(time.March, 1), date(time.May, 1), date(time.January, 2))
+	db.InsertAt("tier", "gold", date(time.May, 1), date(time.July, 1), date(time.January, 3))
+	db.InsertAt("tier", "bronze", date(time.August, 1), date(time.October, 1), date(time.January, 4))
+	// Learned later that the customer was gold in February too
+	db.InsertAt("tier", "gold", date(time.February, 1), date(time.March, 1), date(time.June, 1))
+
+	timeline := func(asOf, from, to time.Time) string {
+		var out []string
+		for _, seg := range db.QueryTimeline("tier", asOf, from, to) {
+			out = append(out, fmt.Sprintf("%v %s-%s", seg.Value, seg.ValidStart.Format("Jan 2"), seg.ValidEnd.Format("Jan 2")))
+		}
+		return fmt.Sprint(out)
+	}
+	tests := []struct {
+		name           string
+		asOf, from, to time.Time
+		want           string
+	}{
+		{"adjacent equal values merge and gaps are left out", date(time.December, 1), date(time.January, 1), date(time.December, 1),
+			"[silver Jan 1-Feb 1 gold Feb 1-Jul 1 bronze Aug 1-Oct 1]"},
+		{"clipped to the range", date(time.December, 1), date(time.April, 1), date(time.September, 1),
+			"[gold Apr 1-Jul 1 bronze Aug 1-Sep 1]"},
+		{"as known before the correction", date(time.March, 1), date(time.January, 1), date(time.July, 1),
+			"[silver Jan 1-Mar 1 gold Mar 1-Jul 1]"},
+		{"nothing in range", date(time.December, 1), date(time.July, 1), date(time.August, 1), "[]"},
+	}
+	for _, tt := range tests {
+		if got := timeline(tt.asOf, tt.from, tt.to); got != tt.want {
+			t.Errorf("%s: timeline = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// A deleted stretch splits the timeline
+	db.DeleteAt("tier", date(time.April, 1), date(time.April, 15), date(time.June, 2))
+	want := "[gold Mar 1-Apr 1 gold Apr 15-Jul 1]"
+	if got := timeline(date(time.December, 1), date(time.March, 1), date(time.July, 1)); got != want {
+		t.Errorf("timeline after delete = %s, want %s", got, want)
+	}
+}
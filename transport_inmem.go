@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnreachable is returned by InmemTransport when the target is not
+	// registered or is cut off from the caller
+	ErrUnreachable = errors.New("inmem: peer unreachable")
+	// ErrDropped is returned by InmemTransport when the network drops a
+	// request or its reply
+	ErrDropped = errors.New("inmem: message dropped")
+)
+
+// inmemRouter carries RPCs between InmemTransports. InmemNetwork is the
+// general purpose router; the simulation tests plug in one that delivers
+// messages in an order they choose.
+type inmemRouter interface {
+	register(t *InmemTransport, handler RPCHandler) error
+	unregister(t *InmemTransport)
+	call(from *InmemTransport, to string, args, reply interface{}, serve func(handler RPCHandler, req []byte) (interface{}, error)) error
+}
+
+// InmemNetwork connects InmemTransports inside one process so a whole
+// cluster can run in a single test. It can partition nodes, delay messages
+// and drop them at random; the randomness comes from a seeded source.
+// Messages are copied through JSON, like on the wire, so nodes never share
+// memory.
+type InmemNetwork struct {
+	mu        sync.Mutex
+	handlers  map[string]RPCHandler
+	groups    map[string]int // partition group per address; absent means group 0
+	minDelay  time.Duration
+	maxDelay  time.Duration
+	dropRate  float64
+	rand      *rand.Rand
+	delivered int64
+	dropped   int64
+}
+
+// NewInmemNetwork creates a fully connected network without delays or drops
+func NewInmemNetwork(seed int64) *InmemNetwork {
+	return &InmemNetwork{
+		handlers: make(map[string]RPCHandler),
+		groups:   make(map[string]int),
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Transport returns the transport for the node at addr
+func (n *InmemNetwork) Transport(addr string) *InmemTransport {
+	return &InmemTransport{addr: addr, network: n}
+}
+
+// Partition splits the network: nodes in different groups cannot reach each
+// other. Addresses not listed form one more group together.
+func (n *InmemNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal reconnects every node
+func (n *InmemNetwork) Heal() {
+	n.Partition()
+}
+
+// SetDelay delays every message by a random duration in [min, max]
+func (n *InmemNetwork) SetDelay(min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.minDelay, n.maxDelay = min, max
+}
+
+// SetDropRate drops each request and each reply with probability p
+func (n *InmemNetwork) SetDropRate(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate = p
+}
+
+// Stats returns how many RPCs were delivered and dropped so far
+func (n *InmemNetwork) Stats() (delivered, dropped int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.delivered, n.dropped
+}
+
+// register makes handler reachable at the transport's address
+func (n *InmemNetwork) register(t *InmemTransport, handler RPCHandler) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.handlers[t.addr]; ok {
+		return fmt.Errorf("inmem: address %s already in use", t.addr)
+	}
+	n.handlers[t.addr] = handler
+	return nil
+}
+
+// unregister removes the handler at the transport's address
+func (n *InmemNetwork) unregister(t *InmemTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.handlers, t.addr)
+}
+
+// route decides the fate of one message from one node to another
+func (n *InmemNetwork) route(from, to string) (RPCHandler, time.Duration, bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	handler, ok := n.handlers[to]
+	if !ok || n.groups[from] != n.groups[to] {
+		return nil, 0, false, ErrUnreachable
+	}
+	delay := n.minDelay
+	if n.maxDelay > n.minDelay {
+		delay += time.Duration(n.rand.Int63n(int64(n.maxDelay - n.minDelay)))
+	}
+	drop := n.dropRate > 0 && n.rand.Float64() < n.dropRate
+	if drop {
+		n.dropped++
+	}
+	return handler, delay, drop, nil
+}
+
+// call delivers a request from one node to another and copies back the
+// reply, applying the network's faults in both directions
+func (n *InmemNetwork) call(t *InmemTransport, to string, args, reply interface{}, serve func(handler RPCHandler, req []byte) (interface{}, error)) error {
+	req, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	from := t.addr
+	handler, delay, drop, err := n.route(from, to)
+	if err != nil {
+		return err
+	}
+	time.Sleep(delay)
+	if drop {
+		return ErrDropped
+	}
+	resp, err := serve(handler, req)
+	if err != nil {
+		return err
+	}
+
+	// The reply travels back over the same, possibly changed, network
+	if _, delay, drop, err = n.route(to, from); err != nil {
+		return err
+	}
+	time.Sleep(delay)
+	if drop {
+		return ErrDropped
+	}
+
+	n.mu.Lock()
+	n.delivered++
+	n.mu.Unlock()
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, reply)
+}
+
+// InmemTransport is one node's endpoint on an InmemNetwork
+type InmemTransport struct {
+	addr    string
+	network inmemRouter
+}
+
+// Serve registers handler for RPCs addressed to this transport
+func (t *InmemTransport) Serve(handler RPCHandler) error {
+	return t.network.register(t, handler)
+}
+
+// RequestVote sends a RequestVote RPC to addr
+func (t *InmemTransport) RequestVote(addr string, args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return t.network.call(t, addr, args, reply, func(handler RPCHandler, req []byte) (interface{}, error) {
+		var in RequestVoteArgs
+		if err := json.Unmarshal(req, &in); err != nil {
+			return nil, err
+		}
+		var out RequestVoteReply
+		handler.handleRequestVote(&in, &out)
+		return &out, nil
+	})
+}
+
+// AppendEntries sends an AppendEntries RPC to addr
+func (t *InmemTransport) AppendEntries(addr string, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return t.network.call(t, addr, args, reply, func(handler RPCHandler, req []byte) (interface{}, error) {
+		var in AppendEntriesArgs
+		if err := json.Unmarshal(req, &in); err != nil {
+			return nil, err
+		}
+		var out AppendEntriesReply
+		handler.handleAppendEntries(&in, &out)
+		return &out, nil
+	})
+}
+
+// InstallSnapshot sends an InstallSnapshot RPC to addr
+func (t *InmemTransport) InstallSnapshot(addr string, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return t.network.call(t, addr, args, reply, func(handler RPCHandler, req []byte) (interface{}, error) {
+		var in InstallSnapshotArgs
+		if err := json.Unmarshal(req, &in); err != nil {
+			return nil, err
+		}
+		var out InstallSnapshotReply
+		handler.handleInstallSnapshot(&in, &out)
+		return &out, nil
+	})
+}
+
+// Join sends a Join RPC to addr
+func (t *InmemTransport) Join(addr string, args *JoinArgs, reply *JoinReply) error {
+	return t.network.call(t, addr, args, reply, func(handler RPCHandler, req []byte) (interface{}, error) {
+		var in JoinArgs
+		if err := json.Unmarshal(req, &in); err != nil {
+			return nil, err
+		}
+		var out JoinReply
+		handler.handleJoin(&in, &out)
+		return &out, nil
+	})
+}
+
+// TimeoutNow sends a TimeoutNow RPC to addr
+func (t *InmemTransport) TimeoutNow(addr string, args *TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return t.network.call(t, addr, args, reply, func(handler RPCHandler, req []byte) (interface{}, error) {
+		var in TimeoutNowArgs
+		if err := json.Unmarshal(req, &in); err != nil {
+			return nil, err
+		}
+		var out TimeoutNowReply
+		handler.handleTimeoutNow(&in, &out)
+		return &out, nil
+	})
+}
+
+// Close unregisters the transport; RPCs addressed to it fail from now on
+func (t *InmemTransport) Close() error {
+	t.network.unregister(t)
+	return nil
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCluster runs RaftNodes with their own DBEngine and CRDTStore on an
+// InmemNetwork. Node IDs double as Raft addresses; see apiAddr for the HTTP
+// addresses the nodes advertise.
+type testCluster struct {
+	t       testing.TB
+	cfg     RaftConfig
+	network *InmemNetwork
+	nodes   map[string]*RaftNode
+	dbs     map[string]*DBEngine
+	clocks  map[string]Clock // the Raft nodes' clocks; the DBEngines keep the wall clock
+}
+
+func newTestCluster(t testing.TB, size int) *testCluster {
+	t.Helper()
+	return newTestClusterWithConfig(t, size, RaftConfig{ElectionTimeoutMS: 100, HeartbeatIntervalMS: 20})
+}
+
+func newTestClusterWithConfig(t testing.TB, size int, cfg RaftConfig) *testCluster {
+	t.Helper()
+	return newTestClusterWithClock(t, size, cfg, realClock{})
+}
+
+func newTestClusterWithClock(t testing.TB, size int, cfg RaftConfig, clock Clock) *testCluster {
+	t.Helper()
+	clocks := make(map[string]Clock)
+	for i := 1; i <= size; i++ {
+		clocks[fmt.Sprintf("n%d", i)] = clock
+	}
+	return newTestClusterWithClocks(t, size, cfg, clocks)
+}
+
+// newTestClusterWithClocks gives each node the clock clocks maps it to; nodes
+// without one use the wall clock
+func newTestClusterWithClocks(t testing.TB, size int, cfg RaftConfig, clocks map[string]Clock) *testCluster {
+	t.Helper()
+	c := &testCluster{
+		t:       t,
+		cfg:     cfg,
+		network: NewInmemNetwork(1),
+		nodes:   make(map[string]*RaftNode),
+		dbs:     make(map[string]*DBEngine),
+		clocks:  clocks,
+	}
+
+	members := make(map[string]string)
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		members[id] = id
+	}
+	for id := range members {
+		c.start(id, members)
+	}
+	return c
+}
+
+// start runs a node on a fresh disk; empty members leave it waiting to join
+func (c *testCluster) start(id string, members map[string]string) *RaftNode {
+	c.t.Helper()
+	dir := c.t.TempDir()
+	db, err := NewDBEngine(dir, DefaultConfig().Database)
+	if err != nil {
+		c.t.Fatalf("NewDBEngine(%s): %v", id, err)
+	}
+	clock, ok := c.clocks[id]
+	if !ok {
+		clock = realClock{}
+	}
+	node, err := newRaftNode(id, c.network.Transport(id), apiAddr(id), dir, c.cfg, members, db, NewCRDTStore(), clock, time.Now().UnixNano())
+	if err != nil {
+		c.t.Fatalf("NewRaftNode(%s): %v", id, err)
+	}
+	c.nodes[id] = node
+	c.dbs[id] = db
+	c.t.Cleanup(func() {
+		node.Shutdown()
+		db.Close()
+	})
+	return node
+}
+
+// apiAddr is the HTTP address node id advertises to its followers. Nothing
+// listens there; API tests call the handlers directly.
+func apiAddr(id string) string {
+	return id + ".api:8080"
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// leader waits for a leader among ids (all nodes if none are given) with a
+// term above minTerm
+func (c *testCluster) leader(minTerm int64, ids ...string) *RaftNode {
+	c.t.Helper()
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+	var leader *RaftNode
+	waitFor(c.t, 5*time.Second, "a leader", func() bool {
+		for _, id := range ids {
+			if state, term := c.nodes[id].GetState(); state == "leader" && term > minTerm {
+				leader = c.nodes[id]
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// write applies an insert through the current leader, retrying while
+// leadership moves
+func (c *testCluster) write(key string, value interface{}) {
+	c.t.Helper()
+	cmd := Command{
+		Type:       CmdInsert,
+		Key:        key,
+		Value:      value,
+		ValidStart: time.Now().Add(-time.Hour),
+		ValidEnd:   time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	waitFor(c.t, 10*time.Second, "write of "+key, func() bool {
+		return c.leader(0).Apply(cmd) == nil
+	})
+}
+
+// converged waits until every listed node has applied value for key
+func (c *testCluster) converged(key string, value interface{}, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		db := c.dbs[id]
+		waitFor(c.t, 5*time.Second, fmt.Sprintf("%s on %s", key, id), func() bool {
+			got, found := db.QueryCurrent(key)
+			return found && got == value
+		})
+	}
+}
+
+func TestInmemClusterReplicatesWrites(t *testing.T) {
+	c := newTestCluster(t, 3)
+	for i := 0; i < 10; i++ {
+		c.write(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		c.converged(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), "n1", "n2", "n3")
+	}
+}
+
+func TestInmemClusterSurvivesLeaderPartition(t *testing.T) {
+	c := newTestCluster(t, 3)
+	old := c.leader(0)
+	c.write("before", "partition")
+
+	var rest []string
+	for id := range c.nodes {
+		if id != old.nodeID {
+			rest = append(rest, id)
+		}
+	}
+	_, oldTerm := old.GetState()
+	c.network.Partition([]string{old.nodeID})
+
+	// The majority side elects a new leader and keeps accepting writes
+	leader := c.leader(oldTerm, rest...)
+	if err := leader.Apply(Command{
+		Type:       CmdInsert,
+		Key:        "during",
+		Value:      "partition",
+		ValidStart: time.Now().Add(-time.Hour),
+		ValidEnd:   time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}); err != nil {
+		t.Fatalf("write on new leader: %v", err)
+	}
+	c.converged("during", "partition", rest...)
+
+	// Once healed the old leader steps down and catches up
+	c.network.Heal()
+	waitFor(t, 5*time.Second, "old leader to step down", func() bool {
+		state, _ := old.GetState()
+		return state == "follower"
+	})
+	c.converged("during", "partition", old.nodeID)
+}
+
+func TestInmemClusterToleratesDropsAndDelays(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.leader(0)
+	c.network.SetDelay(0, 5*time.Millisecond)
+	c.network.SetDropRate(0.1)
+
+	for i := 0; i < 20; i++ {
+		c.write(fmt.Sprintf("key%d", i), i)
+	}
+	c.network.SetDropRate(0)
+	for i := 0; i < 20; i++ {
+		// Values come back from JSON as float64
+		c.converged(fmt.Sprintf("key%d", i), float64(i), "n1", "n2", "n3")
+	}
+	if _, dropped := c.network.Stats(); dropped == 0 {
+		t.Errorf("expected the network to drop some messages")
+	}
+}
+
+func TestInmemClusterPreVoteKeepsPartitionedNodeQuiet(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.write("before", "partition")
+	_, term := leader.GetState()
+
+	var follower *RaftNode
+	for id, node := range c.nodes {
+		if id != leader.nodeID {
+			follower = node
+			break
+		}
+	}
+	// The follower must know the leader's term before it is cut off
+	waitFor(t, 5*time.Second, "the follower to reach the leader's term", func() bool {
+		_, followerTerm := follower.GetState()
+		return followerTerm == term
+	})
+	elections := follower.Stats().Elections
+	c.network.Partition([]string{follower.nodeID})
+
+	// Cut off, the follower keeps failing its pre-vote instead of raising
+	// its term
+	waitFor(t, 5*time.Second, "pre-votes on the partitioned follower", func() bool {
+		return follower.Stats().PreVotes >= 3
+	})
+	if _, followerTerm := follower.GetState(); followerTerm != term {
+		t.Fatalf("partitioned follower moved to term %d, want %d", followerTerm, term)
+	}
+
+	// Rejoining, it does not depose the leader
+	c.network.Heal()
+	c.write("after", "partition")
+	c.converged("after", "partition", follower.nodeID)
+	if state, leaderTerm := leader.GetState(); state != "leader" || leaderTerm != term {
+		t.Fatalf("leader is %s in term %d after the partition healed, want leader in term %d", state, leaderTerm, term)
+	}
+	if started := follower.Stats().Elections - elections; started != 0 {
+		t.Errorf("partitioned follower started %d elections, want 0", started)
+	}
+}
+
+func TestInmemClusterIgnoresNewTermItCannotPersist(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.write("before", "disk failure")
+	_, term := leader.GetState()
+	follower := c.follower(leader)
+	waitFor(t, 5*time.Second, "the follower to reach the leader's term", func() bool {
+		_, followerTerm := follower.GetState()
+		return followerTerm == term
+	})
+
+	// Saving the hard state now fails
+	follower.mu.Lock()
+	dir := follower.storage.dir
+	follower.storage.dir = filepath.Join(t.TempDir(), "missing")
+	savedVote := follower.votedFor
+	follower.mu.Unlock()
+
+	var appendReply AppendEntriesReply
+	follower.handleAppendEntries(&AppendEntriesArgs{Term: term + 1, LeaderID: "newer"}, &appendReply)
+	var voteReply RequestVoteReply
+	follower.handleRequestVote(&RequestVoteArgs{Term: term + 1, CandidateID: "newer", LeadershipTransfer: true}, &voteReply)
+	follower.startElection(false)
+
+	follower.mu.Lock()
+	followerTerm, votedFor, leaderID := follower.currentTerm, follower.votedFor, follower.leaderID
+	follower.storage.dir = dir
+	follower.mu.Unlock()
+
+	if appendReply.Success || appendReply.Term != term {
+		t.Errorf("AppendEntries in an unsaved term replied %+v, want failure in term %d", appendReply, term)
+	}
+	if voteReply.VoteGranted {
+		t.Errorf("vote granted in a term that was not saved")
+	}
+	if followerTerm != term || votedFor != savedVote || leaderID == "newer" {
+		t.Errorf("follower runs in term %d voting for %q under leader %q, want the saved term %d and vote %q",
+			followerTerm, votedFor, leaderID, term, savedVote)
+	}
+}
+
+func TestInmemClusterCheckQuorumStepsDownIsolatedLeader(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.network.Partition([]string{leader.nodeID})
+
+	waitFor(t, 5*time.Second, "isolated leader to step down", func() bool {
+		state, _ := leader.GetState()
+		return state != "leader"
+	})
+	if stepDowns := leader.Stats().CheckQuorumStepDowns; stepDowns != 1 {
+		t.Errorf("CheckQuorumStepDowns = %d, want 1", stepDowns)
+	}
+	if id, _ := leader.Leader(); id != "" {
+		t.Errorf("node still names %q as leader after stepping down", id)
+	}
+}
+
+func TestInmemClusterTransfersLeadership(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.write("before", "transfer")
+	_, term := leader.GetState()
+
+	var target string
+	for id := range c.nodes {
+		if id != leader.nodeID {
+			target = id
+			break
+		}
+	}
+	if err := leader.TransferLeadership(target); err != nil {
+		t.Fatalf("TransferLeadership(%s): %v", target, err)
+	}
+	if state, _ := leader.GetState(); state == "leader" {
+		t.Fatalf("old leader is still leader after the transfer")
+	}
+	if next := c.leader(term); next.nodeID != target {
+		t.Fatalf("leadership went to %s, want %s", next.nodeID, target)
+	}
+
+	c.write("after", "transfer")
+	c.converged("after", "transfer", "n1", "n2", "n3")
+}
+
+func TestInmemClusterTransferLeadershipErrors(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+
+	if err := leader.TransferLeadership("nobody"); !errors.Is(err, ErrInvalidTransfer) {
+		t.Errorf("transfer to a non-member: got %v, want ErrInvalidTransfer", err)
+	}
+	if err := leader.TransferLeadership(leader.nodeID); err != nil {
+		t.Errorf("transfer to the leader itself: %v", err)
+	}
+	for id, node := range c.nodes {
+		if id != leader.nodeID {
+			if err := node.TransferLeadership(""); !errors.Is(err, ErrNotLeader) {
+				t.Errorf("transfer from follower %s: got %v, want ErrNotLeader", id, err)
+			}
+		}
+	}
+
+	// A target that cannot be reached leaves the leader in place
+	var target string
+	for id := range c.nodes {
+		if id != leader.nodeID {
+			target = id
+			break
+		}
+	}
+	c.network.Partition([]string{target})
+	c.write("while", "partitioned")
+	if err := leader.TransferLeadership(target); !errors.Is(err, ErrTransferTimeout) {
+		t.Errorf("transfer to a partitioned node: got %v, want ErrTransferTimeout", err)
+	}
+	if state, _ := leader.GetState(); state != "leader" {
+		t.Errorf("leader is %s after a failed transfer", state)
+	}
+}
+
+func TestInmemClusterIgnoresTimeoutNowNotFromLeader(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.write("before", "timeout-now")
+	_, term := leader.GetState()
+	follower := c.follower(leader)
+	waitFor(t, 5*time.Second, "the follower to follow the leader", func() bool {
+		id, _ := follower.Leader()
+		_, followerTerm := follower.GetState()
+		return id == leader.nodeID && followerTerm == term
+	})
+	elections := follower.Stats().Elections
+
+	for _, args := range []TimeoutNowArgs{
+		{Term: term - 1, LeaderID: leader.nodeID}, // from an earlier term
+		{Term: term + 1, LeaderID: leader.nodeID}, // from a term the follower has not seen
+		{Term: term, LeaderID: "rogue"},           // from a node that does not lead
+	} {
+		var reply TimeoutNowReply
+		follower.handleTimeoutNow(&args, &reply)
+		if reply.Success {
+			t.Errorf("follower accepted TimeoutNow %+v", args)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if state, leaderTerm := leader.GetState(); state != "leader" || leaderTerm != term {
+		t.Fatalf("leader is %s in term %d after bogus TimeoutNow requests, want leader in term %d", state, leaderTerm, term)
+	}
+	if started := follower.Stats().Elections - elections; started != 0 {
+		t.Errorf("follower started %d elections, want 0", started)
+	}
+}
+
+func TestInmemClusterLearnerDoesNotCountTowardsQuorum(t *testing.T) {
+	c := newTestCluster(t, 1)
+	leader := c.leader(0)
+	c.write("before", "learner")
+
+	learner := c.start("n2", map[string]string{})
+	if err := learner.JoinAsLearner("n2", "n2", "n1"); err != nil {
+		t.Fatalf("JoinAsLearner: %v", err)
+	}
+	// Joining again, as a restarted learner does, changes nothing
+	if err := learner.JoinAsLearner("n2", "n2", "n1"); err != nil {
+		t.Fatalf("JoinAsLearner again: %v", err)
+	}
+	c.converged("before", "learner", "n2")
+	if role := learner.Role(); role != RoleLearner {
+		t.Errorf("learner reports role %q, want %q", role, RoleLearner)
+	}
+	if peers := leader.Peers(); len(peers) != 1 || peers[0].ID != "n2" || peers[0].Role != RoleLearner {
+		t.Errorf("leader peers = %+v, want n2 as a learner", peers)
+	}
+
+	// The single voter is a majority on its own, so writes keep committing
+	// while the learner is cut off, and the learner never campaigns
+	c.network.Partition([]string{"n2"})
+	c.write("during", "partition")
+	time.Sleep(500 * time.Millisecond)
+	if stats := learner.Stats(); stats.PreVotes != 0 || stats.Elections != 0 {
+		t.Errorf("learner campaigned: %+v", stats)
+	}
+	c.network.Heal()
+	c.converged("during", "partition", "n2")
+
+	// A promoted learner restarted with -learner stays a voter
+	waitFor(t, 5*time.Second, "promotion", func() bool {
+		return leader.PromoteLearner("n2") == nil
+	})
+	if err := learner.JoinAsLearner("n2", "n2", "n1"); err != nil {
+		t.Fatalf("JoinAsLearner after promotion: %v", err)
+	}
+	if peers := leader.Peers(); len(peers) != 1 || peers[0].Role != RoleVoter {
+		t.Errorf("leader peers = %+v after promotion, want n2 as a voter", peers)
+	}
+}
+
+func TestInmemClusterStatusReportsReplicationProgress(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(0)
+	c.write("before", "partition")
+	c.converged("before", "partition", "n1", "n2", "n3")
+
+	var lagging string
+	for id := range c.nodes {
+		if id != leader.nodeID {
+			lagging = id
+			break
+		}
+	}
+	c.network.Partition([]string{lagging})
+	for i := 0; i < 5; i++ {
+		c.write(fmt.Sprintf("during%d", i), i)
+	}
+
+	status := leader.Status()
+	if status.State != "leader" || status.LeaderID != leader.nodeID {
+		t.Fatalf("leader reports state %q and leader %q", status.State, status.LeaderID)
+	}
+	if status.LastApplied != status.CommitIndex || status.LastLogIndex != status.SnapshotIndex+int64(status.LogSize) {
+		t.Errorf("inconsistent log positions: %+v", status)
+	}
+	if len(status.Peers) != 2 {
+		t.Fatalf("leader reports %d peers, want 2", len(status.Peers))
+	}
+	for _, p := range status.Peers {
+		if p.Progress == nil {
+			t.Fatalf("leader reports no progress for %s", p.ID)
+		}
+		if p.ID == lagging {
+			if p.Progress.Lag < 5 {
+				t.Errorf("partitioned %s lags by %d entries, want at least 5", p.ID, p.Progress.Lag)
+			}
+			continue
+		}
+		waitFor(t, 5*time.Second, p.ID+" to catch up", func() bool {
+			for _, q := range leader.Status().Peers {
+				if q.ID == p.ID {
+					return q.Progress != nil && q.Progress.Lag == 0 && q.Progress.MatchIndex == status.LastLogIndex && q.Progress.LastContactMS >= 0
+				}
+			}
+			return false
+		})
+	}
+
+	// Followers know the leader but not the replication progress
+	for id, node := range c.nodes {
+		if id == leader.nodeID || id == lagging {
+			continue
+		}
+		follower := node.Status()
+		if follower.LeaderID != leader.nodeID {
+			t.Errorf("%s reports leader %q, want %s", id, follower.LeaderID, leader.nodeID)
+		}
+		for _, p := range follower.Peers {
+			if p.Progress != nil {
+				t.Errorf("follower %s reports progress for %s", id, p.ID)
+			}
+		}
+	}
+
+	c.network.Heal()
+	waitFor(t, 5*time.Second, lagging+" to catch up", func() bool {
+		for _, p := range leader.Status().Peers {
+			if p.ID == lagging {
+				return p.Progress != nil && p.Progress.Lag == 0
+			}
+		}
+		return false
+	})
+}
+
+func TestInmemClusterReplicatesDeletes(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.write("doomed", "value")
+	c.converged("doomed", "value", "n1", "n2", "n3")
+
+	cmd := Command{
+		Type:       CmdDelete,
+		Key:        "doomed",
+		ValidStart: time.Now().Add(-time.Minute),
+		ValidEnd:   time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	waitFor(t, 10*time.Second, "delete", func() bool {
+		return c.leader(0).Apply(cmd) == nil
+	})
+	for id, db := range c.dbs {
+		waitFor(t, 5*time.Second, "delete on "+id, func() bool {
+			_, found := db.QueryCurrent("doomed")
+			return !found
+		})
+	}
+}
+
+// skewedClock is the wall clock shifted by a fixed offset
+type skewedClock struct {
+	realClock
+	skew time.Duration
+}
+
+func (c skewedClock) Now() time.Time { return time.Now().Add(c.skew) }
+
+func TestInmemClusterReadsSeeWritesStampedAheadOfLocalClock(t *testing.T) {
+	// The leader stamps transaction times an hour ahead of the clock the
+	// replicas read by
+	c := newTestClusterWithClock(t, 3, RaftConfig{ElectionTimeoutMS: 100, HeartbeatIntervalMS: 20}, skewedClock{skew: time.Hour})
+	c.write("skewed", "first")
+	c.write("skewed", "second")
+
+	leader := c.leader(0)
+	if err := leader.ReadBarrier(ReadLinearizable); err != nil {
+		t.Fatalf("ReadBarrier: %v", err)
+	}
+	db := c.dbs[leader.nodeID]
+	now := time.Now()
+	if _, found := db.QueryTemporal("skewed", now, now); found {
+		t.Fatalf("record stamped an hour ahead is visible as of the local clock; the test clock is not skewed")
+	}
+	if got, found := db.QueryCurrent("skewed"); !found || got != "second" {
+		t.Fatalf("linearizable read on the leader = %v (found %v), want second", got, found)
+	}
+	c.converged("skewed", "second", "n1", "n2", "n3")
+}
+
+func TestInmemClusterTransactionTimesIncreaseAcrossTransfer(t *testing.T) {
+	// n1 stamps transaction times an hour ahead of the node it hands over to
+	c := newTestClusterWithClocks(t, 3, RaftConfig{ElectionTimeoutMS: 100, HeartbeatIntervalMS: 20},
+		map[string]Clock{"n1": skewedClock{skew: time.Hour}})
+	leader := c.leader(0)
+	if leader.nodeID != "n1" {
+		_, term := leader.GetState()
+		if err := leader.TransferLeadership("n1"); err != nil {
+			t.Fatalf("TransferLeadership(n1): %v", err)
+		}
+		leader = c.leader(term, "n1")
+	}
+
+	c.write("skewed", "v1")
+	_, term := leader.GetState()
+	if err := leader.TransferLeadership("n2"); err != nil {
+		t.Fatalf("TransferLeadership(n2): %v", err)
+	}
+	c.leader(term, "n2")
+	c.write("skewed", "v2")
+	c.converged("skewed", "v2", "n1", "n2", "n3")
+
+	for id, db := range c.dbs {
+		var v1, v2 time.Time
+		for i, record := range db.GetHistory("skewed") {
+			if end := record.TransactionTimeEnd; end != nil && end.Before(record.TransactionTime) {
+				t.Errorf("%s: record %d ends at %v, before it was recorded at %v", id, i, *end, record.TransactionTime)
+			}
+			// The slice of v1 left before v2 is recorded along with v2
+			switch {
+			case record.Value == "v1" && v1.IsZero():
+				v1 = record.TransactionTime
+			case record.Value == "v2":
+				v2 = record.TransactionTime
+			}
+		}
+		if !v2.After(v1) {
+			t.Errorf("%s: v2 recorded at %v, not after v1 at %v", id, v2, v1)
+		}
+	}
+}
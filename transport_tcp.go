@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// snapshotTransferRate is the slowest rate, in bytes per second, at which
+// an InstallSnapshot RPC is allowed to send its snapshot
+const snapshotTransferRate = 1 << 20
+
+// TCPTransport serves Raft RPCs as JSON over HTTP on the node's Raft port
+type TCPTransport struct {
+	port       int
+	timeout    time.Duration
+	client     *http.Client
+	joinClient *http.Client
+	server     *http.Server
+}
+
+// NewTCPTransport creates a transport listening on port. timeout bounds
+// every outgoing RPC except Join and InstallSnapshot.
+func NewTCPTransport(port int, timeout time.Duration) *TCPTransport {
+	return &TCPTransport{
+		port:       port,
+		timeout:    timeout,
+		client:     &http.Client{Timeout: timeout},
+		joinClient: &http.Client{Timeout: applyTimeout + time.Second},
+	}
+}
+
+// Serve listens on the Raft port and dispatches RPCs to handler
+func (t *TCPTransport) Serve(handler RPCHandler) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", t.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on raft port: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/request-vote", func(w http.ResponseWriter, req *http.Request) {
+		var args RequestVoteArgs
+		if !decodeRPC(w, req, &args) {
+			return
+		}
+		var reply RequestVoteReply
+		handler.handleRequestVote(&args, &reply)
+		json.NewEncoder(w).Encode(reply)
+	})
+	mux.HandleFunc("/raft/append-entries", func(w http.ResponseWriter, req *http.Request) {
+		var args AppendEntriesArgs
+		if !decodeRPC(w, req, &args) {
+			return
+		}
+		var reply AppendEntriesReply
+		handler.handleAppendEntries(&args, &reply)
+		json.NewEncoder(w).Encode(reply)
+	})
+	mux.HandleFunc("/raft/install-snapshot", func(w http.ResponseWriter, req *http.Request) {
+		var args InstallSnapshotArgs
+		if !decodeRPC(w, req, &args) {
+			return
+		}
+		var reply InstallSnapshotReply
+		handler.handleInstallSnapshot(&args, &reply)
+		json.NewEncoder(w).Encode(reply)
+	})
+	mux.HandleFunc("/raft/join", func(w http.ResponseWriter, req *http.Request) {
+		var args JoinArgs
+		if !decodeRPC(w, req, &args) {
+			return
+		}
+		var reply JoinReply
+		handler.handleJoin(&args, &reply)
+		json.NewEncoder(w).Encode(reply)
+	})
+	mux.HandleFunc("/raft/timeout-now", func(w http.ResponseWriter, req *http.Request) {
+		var args TimeoutNowArgs
+		if !decodeRPC(w, req, &args) {
+			return
+		}
+		var reply TimeoutNowReply
+		handler.handleTimeoutNow(&args, &reply)
+		json.NewEncoder(w).Encode(reply)
+	})
+
+	t.server = &http.Server{Handler: mux}
+	go t.server.Serve(listener)
+	return nil
+}
+
+// RequestVote sends a RequestVote RPC to addr
+func (t *TCPTransport) RequestVote(addr string, args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return postRPC(t.client, addr, "request-vote", args, reply)
+}
+
+// AppendEntries sends an AppendEntries RPC to addr
+func (t *TCPTransport) AppendEntries(addr string, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return postRPC(t.client, addr, "append-entries", args, reply)
+}
+
+// InstallSnapshot sends an InstallSnapshot RPC to addr. A snapshot holds the
+// whole dataset, so the RPC gets time to send it and for the follower to
+// install it on top of the usual timeout.
+func (t *TCPTransport) InstallSnapshot(addr string, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	client := &http.Client{Timeout: snapshotTimeout(t.timeout, len(args.Data))}
+	return postRPC(client, addr, "install-snapshot", args, reply)
+}
+
+// snapshotTimeout bounds an InstallSnapshot RPC carrying size bytes
+func snapshotTimeout(timeout time.Duration, size int) time.Duration {
+	return timeout + applyTimeout + time.Duration(size)*time.Second/snapshotTransferRate
+}
+
+// Join sends a Join RPC to addr
+func (t *TCPTransport) Join(addr string, args *JoinArgs, reply *JoinReply) error {
+	return postRPC(t.joinClient, addr, "join", args, reply)
+}
+
+// TimeoutNow sends a TimeoutNow RPC to addr
+func (t *TCPTransport) TimeoutNow(addr string, args *TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return postRPC(t.client, addr, "timeout-now", args, reply)
+}
+
+// Close stops the RPC server
+func (t *TCPTransport) Close() error {
+	if t.server == nil {
+		return nil
+	}
+	return t.server.Close()
+}
+
+// decodeRPC reads the JSON arguments of an incoming RPC
+func decodeRPC(w http.ResponseWriter, req *http.Request, args interface{}) bool {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(req.Body).Decode(args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return true
+}
+
+// postRPC sends an RPC to the peer at addr and decodes its reply
+func postRPC(client *http.Client, addr, method string, args, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(fmt.Sprintf("http://%s/raft/%s", addr, method), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s to %s failed: %s", method, addr, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
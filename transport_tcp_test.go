@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPTransportGivesSnapshotsLongerThanTheRPCTimeout(t *testing.T) {
+	// A follower that takes longer than the RPC timeout to answer, as one
+	// receiving and installing a large snapshot does
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]int64{"term": 1})
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	transport := NewTCPTransport(0, 100*time.Millisecond)
+	if err := transport.AppendEntries(addr, &AppendEntriesArgs{Term: 1}, &AppendEntriesReply{}); err == nil {
+		t.Fatal("AppendEntries outlived the RPC timeout")
+	}
+	var reply InstallSnapshotReply
+	args := InstallSnapshotArgs{Term: 1, Data: make([]byte, 1<<20)}
+	if err := transport.InstallSnapshot(addr, &args, &reply); err != nil {
+		t.Fatalf("InstallSnapshot: %v", err)
+	}
+	if reply.Term != 1 {
+		t.Errorf("reply term = %d, want 1", reply.Term)
+	}
+
+	if small, large := snapshotTimeout(time.Second, 0), snapshotTimeout(time.Second, 100<<20); large-small != 100*time.Second {
+		t.Errorf("100 MiB snapshot gets %v more than an empty one, want 100s", large-small)
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when appended WAL records are flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every append
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background at a fixed interval
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+const (
+	walSegmentExt     = ".wal"
+	walHeaderSize     = 16 // length (4) + crc (4) + lsn (8)
+	walMaxRecordSize  = 64 * 1024 * 1024
+	walDefaultSegment = 64 * 1024 * 1024
+)
+
+var (
+	walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrWALCorrupt is returned when a record fails its checksum outside the log tail
+	ErrWALCorrupt = errors.New("wal: corrupt record")
+)
+
+// ParseSyncPolicy parses the wal_sync_policy configuration value
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never", "none":
+		return SyncNever, nil
+	}
+	return SyncAlways, fmt.Errorf("unknown WAL sync policy %q", s)
+}
+
+// WALOptions configures a write-ahead log
+type WALOptions struct {
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+	SegmentSize  int64
+}
+
+// WAL is an append-only log of checksummed records split into segment files.
+// Each segment is named after the LSN of its first record, so the name of the
+// active segment always tells us the next LSN even when it is still empty.
+type WAL struct {
+	mu       sync.Mutex
+	dir      string
+	opts     WALOptions
+	segments []uint64 // first LSN of every segment, oldest first
+	file     *os.File
+	size     int64
+	nextLSN  uint64
+	dirty    bool
+	failed   error // set when a failed write could not be undone; refuses further appends
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// OpenWAL opens (or creates) the log in dir, trimming any torn record left at
+// the tail of the last segment by a crash.
+func OpenWAL(dir string, opts WALOptions) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = walDefaultSegment
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = 100 * time.Millisecond
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+
+	w := &WAL{dir: dir, opts: opts}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w.segments = segments
+
+	if len(segments) == 0 {
+		if err := w.openSegment(1); err != nil {
+			return nil, err
+		}
+	} else if err := w.recoverTail(); err != nil {
+		return nil, err
+	}
+
+	if opts.SyncPolicy == SyncInterval {
+		w.stopCh = make(chan struct{})
+		w.doneCh = make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// listSegments returns the first LSN of every segment file in dir, sorted
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		lsn, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, lsn)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (w *WAL) segmentPath(firstLSN uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", firstLSN, walSegmentExt))
+}
+
+// recoverTail scans the last segment, truncates a torn tail and opens it for
+// appending. Only a bad record with nothing valid after it is a torn write;
+// anything else is corruption of records that may have been synced.
+func (w *WAL) recoverTail() error {
+	first := w.segments[len(w.segments)-1]
+	path := w.segmentPath(first)
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+
+	next := first
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		lsn, data, err := readWALRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && lsn != next {
+			file.Close()
+			return fmt.Errorf("%w: %s at offset %d: expected LSN %d, found %d", ErrWALCorrupt, filepath.Base(path), offset, next, lsn)
+		}
+		if err != nil {
+			if err != io.ErrUnexpectedEOF {
+				valid, scanErr := validRecordAfter(file, offset)
+				if scanErr != nil {
+					file.Close()
+					return scanErr
+				}
+				if valid {
+					file.Close()
+					return fmt.Errorf("%s at offset %d: %w", filepath.Base(path), offset, err)
+				}
+			}
+			log.Printf("WAL: discarding torn tail of %s at offset %d\n", filepath.Base(path), offset)
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return fmt.Errorf("failed to truncate WAL segment: %w", err)
+			}
+			break
+		}
+		offset += int64(walHeaderSize + len(data))
+		next++
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek WAL segment: %w", err)
+	}
+	w.file = file
+	w.size = offset
+	w.nextLSN = next
+	return nil
+}
+
+// validRecordAfter reports whether a record passing its checksum starts
+// anywhere in file after the bad one at offset
+func validRecordAfter(file *os.File, offset int64) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat WAL segment: %w", err)
+	}
+	rest := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(rest, offset); err != nil {
+		return false, fmt.Errorf("failed to read WAL segment: %w", err)
+	}
+	for start := 1; start+walHeaderSize <= len(rest); start++ {
+		header := rest[start : start+walHeaderSize]
+		length := int(binary.BigEndian.Uint32(header[0:4]))
+		if length > len(rest)-start-walHeaderSize {
+			continue
+		}
+		data := rest[start+walHeaderSize : start+walHeaderSize+length]
+		if crc32.Update(crc32.Checksum(header[8:16], walCRCTable), walCRCTable, data) == binary.BigEndian.Uint32(header[4:8]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// openSegment creates a new active segment whose first record will be firstLSN
+func (w *WAL) openSegment(firstLSN uint64) error {
+	file, err := os.OpenFile(w.segmentPath(firstLSN), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = 0
+	w.nextLSN = firstLSN
+	if n := len(w.segments); n == 0 || w.segments[n-1] != firstLSN {
+		w.segments = append(w.segments, firstLSN)
+	}
+	return nil
+}
+
+// Append writes a record and returns its LSN
+func (w *WAL) Append(data []byte) (uint64, error) {
+	return w.AppendBatch([][]byte{data})
+}
+
+// AppendBatch writes several records with one write and, under SyncAlways,
+// one fsync, unless the batch has to be split across segments. It returns
+// the LSN of the first record; the others follow in order.
+func (w *WAL) AppendBatch(records [][]byte) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, errors.New("wal: closed")
+	}
+	if w.failed != nil {
+		return 0, w.failed
+	}
+	for _, data := range records {
+		if len(data) > walMaxRecordSize {
+			return 0, fmt.Errorf("wal: record of %d bytes exceeds limit", len(data))
+		}
+	}
+
+	first := w.nextLSN
+	var buf []byte
+	framed := 0
+	for _, data := range records {
+		size := w.size + int64(len(buf))
+		if size > 0 && size+int64(walHeaderSize+len(data)) > w.opts.SegmentSize {
+			if err := w.writeFrames(buf, framed); err != nil {
+				return 0, err
+			}
+			buf, framed = buf[:0], 0
+			if err := w.rotateLocked(); err != nil {
+				return 0, err
+			}
+		}
+		buf = appendWALFrame(buf, w.nextLSN+uint64(framed), data)
+		framed++
+	}
+	if err := w.writeFrames(buf, framed); err != nil {
+		return 0, err
+	}
+
+	switch w.opts.SyncPolicy {
+	case SyncAlways:
+		if err := w.file.Sync(); err != nil {
+			return 0, fmt.Errorf("failed to sync WAL: %w", err)
+		}
+	case SyncInterval:
+		w.dirty = true
+	}
+	return first, nil
+}
+
+// writeFrames writes n encoded records to the active segment. A write that
+// fails part way is cut off again, since records appended after a torn one
+// would be discarded with it on recovery. Callers must hold w.mu.
+func (w *WAL) writeFrames(buf []byte, n int) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := w.file.Write(buf); err != nil {
+		if terr := w.file.Truncate(w.size); terr != nil {
+			w.failed = fmt.Errorf("wal: segment left with a torn record after a failed write: %w", terr)
+		} else if _, serr := w.file.Seek(w.size, io.SeekStart); serr != nil {
+			w.failed = fmt.Errorf("wal: failed to seek back after a failed write: %w", serr)
+		}
+		return fmt.Errorf("failed to write WAL record: %w", err)
+	}
+	w.size += int64(len(buf))
+	w.nextLSN += uint64(n)
+	return nil
+}
+
+// appendWALFrame appends a record framed with its length, checksum and LSN
+func appendWALFrame(buf []byte, lsn uint64, data []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walHeaderSize)...)
+	buf = append(buf, data...)
+	frame := buf[start:]
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(frame[8:16], lsn)
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(frame[8:], walCRCTable))
+	return buf
+}
+
+// Sync flushes the active segment to stable storage
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *WAL) syncLocked() error {
+	if w.file == nil {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+func (w *WAL) syncLoop() {
+	defer close(w.doneCh)
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty {
+				if err := w.syncLocked(); err != nil {
+					log.Printf("WAL: background sync failed: %v\n", err)
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// Rotate seals the active segment and starts a new one
+func (w *WAL) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotateLocked()
+}
+
+func (w *WAL) rotateLocked() error {
+	if w.size == 0 {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL segment: %w", err)
+	}
+	return w.openSegment(w.nextLSN)
+}
+
+// AdvanceTo makes sure the next appended record gets at least the given LSN
+func (w *WAL) AdvanceTo(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if lsn <= w.nextLSN {
+		return nil
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL segment: %w", err)
+	}
+	if w.size == 0 {
+		os.Remove(w.segmentPath(w.segments[len(w.segments)-1]))
+		w.segments = w.segments[:len(w.segments)-1]
+	}
+	return w.openSegment(lsn)
+}
+
+// RemoveBefore deletes sealed segments that only hold records below lsn
+func (w *WAL) RemoveBefore(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	removed := 0
+	for i := 0; i < len(w.segments)-1; i++ {
+		if w.segments[i+1] > lsn {
+			break
+		}
+		if err := os.Remove(w.segmentPath(w.segments[i])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+		removed++
+	}
+	w.segments = w.segments[removed:]
+	if removed > 0 {
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+// FirstLSN returns the LSN of the oldest record still kept in the log
+func (w *WAL) FirstLSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.segments[0]
+}
+
+// NextLSN returns the LSN the next appended record will get
+func (w *WAL) NextLSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextLSN
+}
+
+// LastLSN returns the LSN of the most recently appended record
+func (w *WAL) LastLSN() uint64 {
+	return w.NextLSN() - 1
+}
+
+// Replay calls fn for every record with an LSN greater than after, in order
+func (w *WAL) Replay(after uint64, fn func(lsn uint64, data []byte) error) error {
+	w.mu.Lock()
+	segments := append([]uint64(nil), w.segments...)
+	end := w.nextLSN
+	w.mu.Unlock()
+
+	expected := uint64(0)
+	for i, first := range segments {
+		if i+1 < len(segments) && segments[i+1] <= after+1 {
+			continue
+		}
+		if expected != 0 && first != expected {
+			return fmt.Errorf("%w: gap between LSN %d and segment %d", ErrWALCorrupt, expected, first)
+		}
+
+		file, err := os.Open(w.segmentPath(first))
+		if err != nil {
+			return fmt.Errorf("failed to open WAL segment: %w", err)
+		}
+
+		next := first
+		reader := bufio.NewReader(file)
+		for next < end {
+			lsn, data, err := readWALRecord(reader)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("segment %d: %w", first, err)
+			}
+			if lsn != next {
+				file.Close()
+				return fmt.Errorf("%w: expected LSN %d, found %d", ErrWALCorrupt, next, lsn)
+			}
+			next++
+			if lsn <= after {
+				continue
+			}
+			if err := fn(lsn, data); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		file.Close()
+		expected = next
+	}
+	return nil
+}
+
+// Close stops background syncing, flushes and closes the active segment
+func (w *WAL) Close() error {
+	if w.stopCh != nil {
+		close(w.stopCh)
+		<-w.doneCh
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	return err
+}
+
+// readWALRecord reads a single framed record and verifies its checksum
+func readWALRecord(r io.Reader) (uint64, []byte, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > walMaxRecordSize {
+		return 0, nil, fmt.Errorf("%w: record length %d", ErrWALCorrupt, length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[8:16], walCRCTable), walCRCTable, data)
+	if crc != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", ErrWALCorrupt)
+	}
+	return binary.BigEndian.Uint64(header[8:16]), data, nil
+}
+
+// syncDir fsyncs a directory so that created or removed files are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
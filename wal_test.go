@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// openTestWAL opens the log in dir and closes it when the test ends
+func openTestWAL(t *testing.T, dir string, opts WALOptions) *WAL {
+	t.Helper()
+	w, err := OpenWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenWAL: %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// replayAll returns the payload of every record in the log
+func replayAll(t *testing.T, w *WAL) []string {
+	t.Helper()
+	var records []string
+	if err := w.Replay(0, func(lsn uint64, data []byte) error {
+		records = append(records, string(data))
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	return records
+}
+
+func TestWALRefusesAppendsAfterUnrecoverableWrite(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, WALOptions{})
+	if _, err := w.Append([]byte("kept")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// A descriptor that can neither write nor truncate the segment
+	w.file.Close()
+	var err error
+	if w.file, err = os.Open(w.segmentPath(1)); err != nil {
+		t.Fatalf("reopen segment: %v", err)
+	}
+	if _, err := w.Append([]byte("lost")); err == nil {
+		t.Fatal("Append succeeded on a read-only segment")
+	}
+	if w.failed == nil {
+		t.Fatal("WAL not marked failed after a write it could not undo")
+	}
+	if _, err := w.Append([]byte("after")); err == nil {
+		t.Fatal("Append succeeded after an unrecoverable write failure")
+	}
+	w.Close()
+
+	w = openTestWAL(t, dir, WALOptions{})
+	if records := replayAll(t, w); len(records) != 1 || records[0] != "kept" {
+		t.Fatalf("log holds %q after reopening, want only the record written before the failure", records)
+	}
+}
+
+func TestWALTrimsTornTail(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		tail func(frame []byte) []byte
+	}{
+		{"torn header", func(frame []byte) []byte { return frame[:walHeaderSize/2] }},
+		{"torn payload", func(frame []byte) []byte { return frame[:len(frame)-2] }},
+		{"checksum mismatch", func(frame []byte) []byte {
+			frame[len(frame)-1] ^= 0xff
+			return frame
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openTestWAL(t, dir, WALOptions{})
+			for _, data := range []string{"a", "b", "c"} {
+				if _, err := w.Append([]byte(data)); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			w.Close()
+
+			// A crash in the middle of appending record 4
+			file, err := os.OpenFile(w.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatalf("open segment: %v", err)
+			}
+			if _, err := file.Write(tt.tail(appendWALFrame(nil, 4, []byte("torn")))); err != nil {
+				t.Fatalf("write torn tail: %v", err)
+			}
+			file.Close()
+
+			w = openTestWAL(t, dir, WALOptions{})
+			if records := replayAll(t, w); !reflect.DeepEqual(records, []string{"a", "b", "c"}) {
+				t.Fatalf("log holds %q after recovery, want a, b, c", records)
+			}
+			// The next record takes the torn one's place
+			if lsn, err := w.Append([]byte("d")); err != nil || lsn != 4 {
+				t.Fatalf("Append after recovery = LSN %d, %v; want LSN 4", lsn, err)
+			}
+			w.Close()
+
+			w = openTestWAL(t, dir, WALOptions{})
+			if records := replayAll(t, w); !reflect.DeepEqual(records, []string{"a", "b", "c", "d"}) {
+				t.Fatalf("log holds %q after reopening, want a, b, c, d", records)
+			}
+		})
+	}
+}
+
+func TestWALRefusesCorruptionBeforeTail(t *testing.T) {
+	frameSize := int64(walHeaderSize + 1)
+	for _, tt := range []struct {
+		name   string
+		offset int64 // into the second record
+	}{
+		{"length", 0},
+		{"checksum", 4},
+		{"lsn", 15},
+		{"payload", walHeaderSize},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openTestWAL(t, dir, WALOptions{})
+			for _, data := range []string{"a", "b", "c"} {
+				if _, err := w.Append([]byte(data)); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			w.Close()
+
+			file, err := os.OpenFile(w.segmentPath(1), os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatalf("open segment: %v", err)
+			}
+			b := make([]byte, 1)
+			if _, err := file.ReadAt(b, frameSize+tt.offset); err != nil {
+				t.Fatalf("read segment: %v", err)
+			}
+			b[0] ^= 0xff
+			if _, err := file.WriteAt(b, frameSize+tt.offset); err != nil {
+				t.Fatalf("corrupt segment: %v", err)
+			}
+			file.Close()
+
+			// Record c follows the damage, so it is no torn write
+			if w, err := OpenWAL(dir, WALOptions{}); !errors.Is(err, ErrWALCorrupt) {
+				if err == nil {
+					w.Close()
+				}
+				t.Fatalf("OpenWAL = %v, want ErrWALCorrupt", err)
+			}
+			info, err := os.Stat(w.segmentPath(1))
+			if err != nil {
+				t.Fatalf("stat segment: %v", err)
+			}
+			if info.Size() != 3*frameSize {
+				t.Fatalf("segment is %d bytes after the failed open, want %d", info.Size(), 3*frameSize)
+			}
+		})
+	}
+}
+
+func TestWALRotatesSegments(t *testing.T) {
+	dir := t.TempDir()
+	// Room for two 8-byte records per segment
+	w := openTestWAL(t, dir, WALOptions{SegmentSize: 2 * (walHeaderSize + 8)})
+
+	var want []string
+	for i := 1; i <= 5; i++ {
+		want = append(want, fmt.Sprintf("record%d", i))
+	}
+	if _, err := w.AppendBatch([][]byte{[]byte(want[0]), []byte(want[1]), []byte(want[2])}); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	for _, data := range want[3:] {
+		if _, err := w.Append([]byte(data)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatalf("listSegments: %v", err)
+	}
+	if !reflect.DeepEqual(segments, []uint64{1, 3, 5}) {
+		t.Fatalf("segments start at LSNs %v, want [1 3 5]", segments)
+	}
+	if records := replayAll(t, w); !reflect.DeepEqual(records, want) {
+		t.Fatalf("log holds %q, want %q", records, want)
+	}
+
+	// Segments wholly below the LSN go; the one holding it stays
+	if err := w.RemoveBefore(4); err != nil {
+		t.Fatalf("RemoveBefore: %v", err)
+	}
+	if segments, _ := listSegments(dir); !reflect.DeepEqual(segments, []uint64{3, 5}) {
+		t.Fatalf("segments after RemoveBefore(4) start at LSNs %v, want [3 5]", segments)
+	}
+	if first := w.FirstLSN(); first != 3 {
+		t.Errorf("FirstLSN = %d, want 3", first)
+	}
+	var replayed []string
+	if err := w.Replay(3, func(lsn uint64, data []byte) error {
+		replayed = append(replayed, string(data))
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if !reflect.DeepEqual(replayed, want[3:]) {
+		t.Errorf("Replay after LSN 3 = %q, want %q", replayed, want[3:])
+	}
+}